@@ -3,419 +3,4486 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
+	"github.com/atotto/clipboard"
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 	"github.com/spf13/viper"
+	"golang.org/x/term"
 )
 
+// Build info, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+const welcomeText = "Welcome to OpenRouter Chat!\nEnter your message below and press Enter to send.\n"
+
+// modelSlugPattern matches OpenRouter model slugs such as "anthropic/claude-3-opus"
+var modelSlugPattern = regexp.MustCompile(`^[\w.-]+/[\w.:-]+$`)
+
+// commandNamePattern matches a word that reads as a slash command, such as
+// "/clear", as opposed to a path such as "/usr/bin"
+var commandNamePattern = regexp.MustCompile(`^/[A-Za-z][\w-]*$`)
+
+// modelOverridePattern matches a message prefixed with "@provider/name " to
+// send just that message to another model
+var modelOverridePattern = regexp.MustCompile(`^@(\S+)\s+(?s:(.+))$`)
+
+// orderedListPattern matches numbered list items such as "2. Second"
+var orderedListPattern = regexp.MustCompile(`^(\d+)\.\s+(.*)$`)
+
+// tviewTagPattern matches a tview style or region tag at the start of a string
+var tviewTagPattern = regexp.MustCompile(`^\[(?:"[^"]*"|[a-zA-Z0-9_,;: \-\.#]+)\]`)
+
+// headingPattern matches ATX headings such as "## Section"
+var headingPattern = regexp.MustCompile(`^(#{1,6})(?:\s+(.*))?$`)
+
+// pendingHeadingPattern matches the start of a line that may still become a
+// heading once more text arrives. The spaces after the marks are held too,
+// since the heading text starts after all of them.
+var pendingHeadingPattern = regexp.MustCompile(`^#{1,6}\s*$`)
+
+// ruleLinePattern matches a horizontal rule such as "---", "***" or "_ _ _"
+var ruleLinePattern = regexp.MustCompile(`^(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+
+// ruleWidth is how many columns a horizontal rule spans when the view width
+// is not known yet
+const ruleWidth = 40
+
+// linkPattern matches an inline link such as "[text](https://example.com)"
+var linkPattern = regexp.MustCompile(`^\[([^\]]+)\]\(([^)\s]+)\)`)
+
+// pendingLinkPattern matches the start of a link that is still arriving
+var pendingLinkPattern = regexp.MustCompile(`^\[(?:[^\]]*|[^\]]+\](?:\([^)\s]*)?)$`)
+
+// imagePattern matches an inline image such as "![diagram](https://example.com/a.png)"
+var imagePattern = regexp.MustCompile(`^!\[([^\]]*)\]\(([^)\s]+)\)`)
+
+// pendingImagePattern matches the start of an image that is still arriving
+var pendingImagePattern = regexp.MustCompile(`^!\[[^\]]*(?:\](?:\([^)\s]*)?)?$`)
+
+// pendingOrderedPattern matches the start of a line that may still become a
+// numbered list item once more text arrives
+var pendingOrderedPattern = regexp.MustCompile(`^\d+(\.\s*)?$`)
+
+// taskPattern matches the checkbox of a task list item such as "- [x] done"
+var taskPattern = regexp.MustCompile(`^\[([ xX])\](?:[ \t]|$)`)
+
+// pendingTaskPattern matches the start of a list item that may still become
+// a task once more text arrives
+var pendingTaskPattern = regexp.MustCompile(`^[-*] \[(?:[ xX]\]?)?$`)
+
+// tableSeparatorPattern matches a single cell of a table separator row
+var tableSeparatorPattern = regexp.MustCompile(`^:?-+:?$`)
+
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Images are data URLs sent along with Content as multimodal parts
+	Images []string `json:"-"`
+	// Time is when the message was sent; it is only kept in history files
+	Time time.Time `json:"-"`
+	// Model is the model a user message was sent to with @model, so /retry
+	// and /continue use it too. It is empty for the configured model.
+	Model string `json:"-"`
+}
+
+// ContentPart is one part of a multimodal message content array
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+// MarshalJSON writes content as a plain string, or as an array of text and
+// image parts when the message has images
+func (m Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Role    string `json:"role"`
+		Content any    `json:"content"`
+	}{m.Role, m.content()})
+}
+
+// content returns the content in the form MarshalJSON writes
+func (m Message) content() any {
+	if len(m.Images) == 0 {
+		return m.Content
+	}
+	parts := []ContentPart{{Type: "text", Text: m.Content}}
+	for _, image := range m.Images {
+		parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: image}})
+	}
+	return parts
+}
+
+// storedMessage is a message as written to history files, which also keep
+// the time it was sent and any @model override
+type storedMessage Message
+
+func (m storedMessage) MarshalJSON() ([]byte, error) {
+	var sent *time.Time
+	if !m.Time.IsZero() {
+		sent = &m.Time
+	}
+	return json.Marshal(struct {
+		Role    string     `json:"role"`
+		Content any        `json:"content"`
+		Time    *time.Time `json:"time,omitempty"`
+		Model   string     `json:"model,omitempty"`
+	}{m.Role, Message(m).content(), sent, m.Model})
+}
+
+// UnmarshalJSON reads content in either form written by MarshalJSON, and the
+// time and model written by storedMessage
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+		Time    time.Time       `json:"time"`
+		Model   string          `json:"model"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*m = Message{Role: raw.Role, Time: raw.Time, Model: raw.Model}
+	if len(raw.Content) == 0 || raw.Content[0] != '[' {
+		return json.Unmarshal(raw.Content, &m.Content)
+	}
+
+	var parts []ContentPart
+	if err := json.Unmarshal(raw.Content, &parts); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		switch {
+		case part.Type == "text":
+			m.Content += part.Text
+		case part.Type == "image_url" && part.ImageURL != nil:
+			m.Images = append(m.Images, part.ImageURL.URL)
+		}
+	}
+	return nil
 }
 
 type CompletionRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	Stream    bool      `json:"stream"`
-	MaxTokens int       `json:"max_tokens,omitempty"`
+	Model       string    `json:"model"`
+	Models      []string  `json:"models,omitempty"` // Fallbacks tried after Model
+	Messages    []Message `json:"messages"`
+	Stream      bool      `json:"stream"`
+	MaxTokens   int       `json:"max_tokens,omitempty"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	TopP        *float64  `json:"top_p,omitempty"`
+
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	Transforms       []string `json:"transforms,omitempty"`
+
+	Provider       *ProviderPreferences `json:"provider,omitempty"`
+	StreamOptions  *StreamOptions       `json:"stream_options,omitempty"`
+	ResponseFormat *ResponseFormat      `json:"response_format,omitempty"`
+}
+
+// ResponseFormat constrains the format of the response
+type ResponseFormat struct {
+	Type string `json:"type"`
+}
+
+// ProviderPreferences control which upstream providers OpenRouter routes to
+type ProviderPreferences struct {
+	Order          []string `json:"order,omitempty" mapstructure:"order"`
+	AllowFallbacks *bool    `json:"allow_fallbacks,omitempty" mapstructure:"allow_fallbacks"`
+	Ignore         []string `json:"ignore,omitempty" mapstructure:"ignore"`
+	// "allow" or "deny" providers that may store or train on prompts
+	DataCollection string `json:"data_collection,omitempty" mapstructure:"data_collection"`
+}
+
+// ModelProfile overrides sampling parameters while its model is in use.
+// Unset fields keep the top-level values.
+type ModelProfile struct {
+	Temperature *float64 `mapstructure:"temperature"`
+	MaxTokens   int      `mapstructure:"max_tokens"`
+	TopP        *float64 `mapstructure:"top_p"`
+	// Seconds to wait for response headers, e.g. longer for slow reasoning models
+	Timeout int `mapstructure:"timeout"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// Usage holds the exact token accounting sent in the final stream chunk
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 type CompletionResponse struct {
-	Choices []struct {
+	// Where OpenRouter routed the request, which may differ from the request
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Choices  []struct {
 		Delta struct {
-			Content string `json:"content"`
+			Content   string `json:"content"`
+			Reasoning string `json:"reasoning"` // Thinking trace of reasoning models
 		} `json:"delta"`
+		// Why generation stopped, sent with the last content chunk
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// ChatCompletion is a complete response to a non-streamed request
+type ChatCompletion struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Choices  []struct {
+		Message struct {
+			Content   string `json:"content"`
+			Reasoning string `json:"reasoning"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// ModelInfo describes a model listed by the OpenRouter models endpoint
+type ModelInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	ContextLength int    `json:"context_length"`
+	Pricing       struct {
+		Prompt     string `json:"prompt"`
+		Completion string `json:"completion"`
+	} `json:"pricing"`
+}
+
+type ModelsResponse struct {
+	Data []ModelInfo `json:"data"`
+}
+
+// ErrorResponse is the envelope OpenRouter wraps API errors in
+type ErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// apiErrorMessage returns the message of an error response, or the raw body
+// when it isn't the usual error envelope
+func apiErrorMessage(body []byte) string {
+	var errResp ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Error.Message == "" {
+		return strings.TrimSpace(string(body))
+	}
+	return errResp.Error.Message
 }
 
 type Config struct {
 	OpenRouter struct {
-		APIKey    string `mapstructure:"api_key"`
-		Model     string `mapstructure:"model"`
-		Timeout   int    `mapstructure:"timeout"`
-		MaxTokens int    `mapstructure:"max_tokens"`
+		APIKey string `mapstructure:"api_key"`
+		// Further keys; requests rotate through all keys and move on to the
+		// next one when a key is rejected or rate limited
+		APIKeys []string `mapstructure:"api_keys"`
+		// Root of the API, e.g. a proxy or an OpenRouter-compatible gateway
+		BaseURL string `mapstructure:"base_url"`
+		Model   string `mapstructure:"model"`
+		Timeout int    `mapstructure:"timeout"` // Seconds to wait for response headers
+		// Seconds without streamed data before a response is considered stalled
+		IdleTimeout int `mapstructure:"idle_timeout"`
+		// Times a request is retried when the connection fails, e.g. on a
+		// DNS error or a refused connection, before giving up
+		ConnectRetries int `mapstructure:"connect_retries"`
+		MaxTokens      int `mapstructure:"max_tokens"`
+		// Sampling parameters are nil when unset so the model defaults apply
+		Temperature      *float64 `mapstructure:"temperature"`
+		TopP             *float64 `mapstructure:"top_p"`
+		FrequencyPenalty *float64 `mapstructure:"frequency_penalty"`
+		PresencePenalty  *float64 `mapstructure:"presence_penalty"`
+		// Sequences that end the response when generated
+		Stop []string `mapstructure:"stop"`
+		// Sampling seed for reproducible outputs where the provider honors it
+		Seed *int `mapstructure:"seed"`
+		// Parameters per model slug. Slugs contain dots, which viper reads as
+		// key separators, so the map is decoded on its own in loadConfig.
+		ModelProfiles map[string]ModelProfile `mapstructure:"-"`
+		// Provider routing, nil leaves routing to OpenRouter
+		Provider *ProviderPreferences `mapstructure:"provider"`
+		// Models OpenRouter falls back to, in order, when the model is
+		// unavailable; the status bar shows which one served a response
+		FallbackModels []string `mapstructure:"fallback_models"`
+		// Prompt transforms OpenRouter applies, e.g. "middle-out" to compress
+		// a conversation that doesn't fit the model's context
+		Transforms []string `mapstructure:"transforms"`
+		// "json_object" asks the model for a JSON response, which is then
+		// shown pretty-printed; "text" or empty leaves the format to the model
+		ResponseFormat string `mapstructure:"response_format"`
+
+		SystemPrompt string `mapstructure:"system_prompt"`
+		// Wraps every user message when sent, e.g. "Translate to French:
+		// {input}"; the chat still shows the message as typed
+		PromptTemplate string `mapstructure:"prompt_template"`
+		// Ask before sending when the conversation is estimated to be larger
+		// than this many tokens, 0 disables the prompt
+		ConfirmAboveTokens int `mapstructure:"confirm_above_tokens"`
+		// Drop the oldest messages before sending once the conversation is
+		// estimated to be larger than this many tokens, 0 keeps everything
+		MaxContextTokens int `mapstructure:"max_context_tokens"`
+		// Keep only this many of the newest messages in the chat view, 0
+		// shows them all; the conversation sent to the model is unaffected
+		MaxDisplayMessages int `mapstructure:"max_display_messages"`
+		// Loading indicator shown while a response is generated
+		SpinnerFrames []string `mapstructure:"spinner_frames"`
+		SpinnerText   string   `mapstructure:"spinner_text"`
+		// Names shown before messages; "{model}" in the assistant label is
+		// replaced with the current model
+		UserLabel      string `mapstructure:"user_label"`
+		AssistantLabel string `mapstructure:"assistant_label"`
+		// Stream responses as they are generated instead of waiting for the
+		// whole response
+		Stream bool `mapstructure:"stream"`
+		// Save the history after every response instead of only on exit
+		Autosave bool `mapstructure:"autosave"`
+		// Keep the inputs recalled with Up/Down across restarts
+		SaveInputHistory bool `mapstructure:"save_input_history"`
+		// Show the time each message was sent before it
+		ShowTimestamps bool `mapstructure:"show_timestamps"`
+		// Render markdown in responses; off shows them verbatim
+		RenderMarkdown bool `mapstructure:"render_markdown"`
+		// Show a run of empty lines in a response as a single one
+		CollapseBlankLines bool `mapstructure:"collapse_blank_lines"`
+		// Column responses are wrapped at, 0 wraps at the view width
+		WrapWidth int `mapstructure:"wrap_width"`
+		// Bytes of a line scanned for markdown before the rest of it is
+		// shown verbatim, 0 for no limit
+		MaxMarkdownLineLength int `mapstructure:"max_markdown_line_length"`
+		// Show the thinking trace of reasoning models above the answer
+		ShowReasoning bool `mapstructure:"show_reasoning"`
+		// Attribution headers shown in the OpenRouter dashboard
+		Referer string `mapstructure:"referer"`
+		Title   string `mapstructure:"title"`
+		// Extra headers sent with every request, e.g. for a gateway
+		Headers map[string]string `mapstructure:"headers"`
+		// Debug log of requests and raw stream lines; also receives the
+		// messages otherwise printed to stderr
+		LogFile string `mapstructure:"log_file"`
 	} `mapstructure:"openrouter"`
+
+	// Theme selects a color preset; any role can be overridden by color name
+	Theme struct {
+		Name       string `mapstructure:"name"`
+		User       string `mapstructure:"user"`
+		Assistant  string `mapstructure:"assistant"`
+		System     string `mapstructure:"system"`
+		Border     string `mapstructure:"border"`
+		Input      string `mapstructure:"input"`
+		Text       string `mapstructure:"text"`
+		Background string `mapstructure:"background"`
+		Status     string `mapstructure:"status"` // Status bar and filter labels
+		Heading    string `mapstructure:"heading"`
+	} `mapstructure:"theme"`
+
+	// Keybindings name the key of each action, e.g. "Ctrl+Q" or "Alt+Enter".
+	// An empty name leaves the action without a key, as clear is by default.
+	Keybindings struct {
+		Quit   string `mapstructure:"quit"`
+		Send   string `mapstructure:"send"`
+		Clear  string `mapstructure:"clear"`
+		Cancel string `mapstructure:"cancel"`
+		Copy   string `mapstructure:"copy"`
+		// Moves the focus between the conversation and the input
+		Focus string `mapstructure:"focus"`
+		// Removes the last exchange. Most terminals send Ctrl+Backspace as
+		// a plain Backspace, so it can't be told apart to be bound here.
+		Undo string `mapstructure:"undo"`
+	} `mapstructure:"keybindings"`
+
+	// Keys are the parsed keybindings
+	Keys KeyMap `mapstructure:"-"`
+
+	// Offline answers from a local stub instead of the API, set by -offline
+	Offline bool `mapstructure:"-"`
+
+	// MaxTokensOverride is set by -max-tokens and wins over model profiles
+	MaxTokensOverride int `mapstructure:"-"`
+}
+
+// KeyBinding is a key, optionally pressed with Alt. The zero value binds no key.
+type KeyBinding struct {
+	Key   tcell.Key
+	Alt   bool
+	bound bool
+}
+
+// Matches reports whether event is the bound key
+func (b KeyBinding) Matches(event *tcell.EventKey) bool {
+	return b.bound && event.Key() == b.Key && (event.Modifiers()&tcell.ModAlt != 0) == b.Alt
+}
+
+// KeyMap holds the key bound to each configurable action
+type KeyMap struct {
+	Quit   KeyBinding
+	Send   KeyBinding
+	Clear  KeyBinding
+	Cancel KeyBinding
+	Copy   KeyBinding
+	Focus  KeyBinding
+	Undo   KeyBinding
+}
+
+// keyNames maps lowercase key names such as "ctrl+c", "enter" or "f1" to keys
+var keyNames = func() map[string]tcell.Key {
+	names := make(map[string]tcell.Key)
+	for key, name := range tcell.KeyNames {
+		names[strings.ToLower(strings.ReplaceAll(name, "-", "+"))] = key
+	}
+	// Some Ctrl keys share their code with a named key, e.g. Ctrl+M is Enter
+	for c := 'a'; c <= 'z'; c++ {
+		names["ctrl+"+string(c)] = tcell.KeyCtrlA + tcell.Key(c-'a')
+	}
+	return names
+}()
+
+// parseKeyBinding parses a key name such as "Ctrl+L", "Esc" or "Alt+Enter".
+// An empty name leaves the action unbound.
+func parseKeyBinding(name string) (KeyBinding, error) {
+	var binding KeyBinding
+	lower := strings.ToLower(strings.TrimSpace(name))
+	if lower == "" {
+		return binding, nil
+	}
+	if rest, ok := strings.CutPrefix(lower, "alt+"); ok {
+		binding.Alt = true
+		lower = rest
+	}
+
+	key, ok := keyNames[lower]
+	if !ok {
+		return binding, fmt.Errorf("unknown key %q", name)
+	}
+	binding.Key = key
+	binding.bound = true
+	return binding, nil
+}
+
+// Theme holds the colors of the chat UI
+type Theme struct {
+	User       tcell.Color
+	Assistant  tcell.Color
+	System     tcell.Color
+	Border     tcell.Color
+	Input      tcell.Color
+	Text       tcell.Color
+	Background tcell.Color
+	Status     tcell.Color
+	Heading    tcell.Color
+}
+
+// themes are the built-in presets selectable by name
+var themes = map[string]Theme{
+	"dark": {
+		User:       tcell.ColorPurple,
+		Assistant:  tcell.ColorBlue,
+		System:     tcell.ColorRed,
+		Border:     tcell.ColorBlue,
+		Input:      tcell.ColorGreen,
+		Text:       tcell.ColorWhite,
+		Background: tcell.ColorBlack,
+		Status:     tcell.ColorYellow,
+		Heading:    tcell.ColorYellow,
+	},
+	"light": {
+		User:       tcell.ColorDarkMagenta,
+		Assistant:  tcell.ColorNavy,
+		System:     tcell.ColorMaroon,
+		Border:     tcell.ColorNavy,
+		Input:      tcell.ColorDarkGreen,
+		Text:       tcell.ColorBlack,
+		Background: tcell.ColorWhite,
+		Status:     tcell.ColorOlive,
+		Heading:    tcell.ColorNavy,
+	},
+	"solarized": {
+		User:       tcell.GetColor("#d33682"),
+		Assistant:  tcell.GetColor("#268bd2"),
+		System:     tcell.GetColor("#dc322f"),
+		Border:     tcell.GetColor("#268bd2"),
+		Input:      tcell.GetColor("#859900"),
+		Text:       tcell.GetColor("#93a1a1"),
+		Background: tcell.GetColor("#002b36"),
+		Status:     tcell.GetColor("#b58900"),
+		Heading:    tcell.GetColor("#b58900"),
+	},
+}
+
+const defaultTheme = "dark"
+
+// themeNames lists the preset names in a stable order
+func themeNames() []string {
+	names := make([]string, 0, len(themes))
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveTheme starts from the configured preset and applies the per-role
+// overrides. Unknown presets and color names fall back to the defaults.
+func resolveTheme(cfg *Config) Theme {
+	name := cfg.Theme.Name
+	if name == "" {
+		name = defaultTheme
+	}
+	theme, ok := themes[name]
+	if !ok {
+		log.Printf("Unknown theme %q, using %q", name, defaultTheme)
+		theme = themes[defaultTheme]
+	}
+
+	for _, override := range []struct {
+		role  string
+		name  string
+		color *tcell.Color
+	}{
+		{"user", cfg.Theme.User, &theme.User},
+		{"assistant", cfg.Theme.Assistant, &theme.Assistant},
+		{"system", cfg.Theme.System, &theme.System},
+		{"border", cfg.Theme.Border, &theme.Border},
+		{"input", cfg.Theme.Input, &theme.Input},
+		{"text", cfg.Theme.Text, &theme.Text},
+		{"background", cfg.Theme.Background, &theme.Background},
+		{"status", cfg.Theme.Status, &theme.Status},
+		{"heading", cfg.Theme.Heading, &theme.Heading},
+	} {
+		if override.name == "" {
+			continue
+		}
+		color := tcell.GetColor(strings.ToLower(override.name))
+		if color == tcell.ColorDefault {
+			log.Printf("Invalid %s color %q, keeping the theme default", override.role, override.name)
+			continue
+		}
+		*override.color = color
+	}
+	return theme
 }
 
-// MarkdownParser handles Markdown rendering for assistant responses
+const (
+	defaultReferer = "github.com/reVost/go-openrouter"
+	defaultTitle   = "Go OpenRouter Client"
+)
+
+// MarkdownParser handles Markdown rendering for assistant responses.
+// Text may be fed in arbitrary chunks: inline and block state carries over
+// between calls, and anything whose rendering still depends on text that has
+// not arrived yet is held back until a later call or Flush.
 type MarkdownParser struct {
 	inBold      bool
 	inItalic    bool
+	inUnderline bool
+	inStrike    bool
 	inCode      bool
-	inQuote     bool
 	inList      bool
+	inOrdered   bool
+	heading     int   // Level of the heading on the open line, 0 if none
+	taskDone    bool  // The open line is a completed task, shown dimmed
+	listIndents []int // Indentation of the enclosing list items, outermost first
 	buffer      *strings.Builder
-	partialMode bool // For streaming mode
+
+	// Render a run of empty lines as a single one, the same way whether the
+	// text is streamed or rendered at once
+	collapseBlankLines bool
+
+	// Show the text verbatim, only escaped and with tabs expanded, instead
+	// of rendering markdown
+	raw bool
+
+	// Color of level 1 and 2 headings, from the theme
+	headingColor tcell.Color
+
+	// Length of the run of tag characters since the last literal "[" of the
+	// model text on this line, or -1 if there is none
+	tagRun int
+	// Whether the model text ends in "[", tag characters and then only more
+	// "[", as in "[red[", whose next "]" tview would also take for a tag
+	tagBrackets bool
+
+	// Streaming state
+	pending       string // Text received but not rendered yet
+	lineOpen      bool   // The current line's block prefix has been written
+	prevLineEmpty bool
+
+	// Past maxLineLength bytes a line is written verbatim, since scanning a
+	// huge line such as a base64 blob for markup can stall rendering; 0
+	// leaves lines unlimited. lineLength counts the bytes of the open line
+	// rendered so far, and longLine keeps a long line that can't be started
+	// yet aside instead of in pending, where every chunk would copy it.
+	maxLineLength int
+	lineLength    int
+	lineVerbatim  bool
+	longLine      *strings.Builder
+
+	// Table rows are buffered until the table ends so columns can be aligned
+	tableRows []string
+
+	// Fenced code block state
+	inCodeBlock bool
+	codeLang    string
+	codeLines   []string
+
+	// Width of the view the output is shown in, 0 if unknown. widthUsed
+	// records that output laid out to the width was rendered since Reset.
+	width     int
+	widthUsed bool
+
+	// Lines are broken between words at wrapWidth columns when it is set.
+	// startColumn is where the output starts on its first line, e.g. after
+	// a label; column is the width of the current output line so far, and
+	// wrapPending holds the last word of the output until it is complete.
+	// wrapWord records that the current word was partly written already.
+	wrapWidth   int
+	startColumn int
+	column      int
+	wrapPending string
+	wrapWord    bool
 }
 
 func NewMarkdownParser() *MarkdownParser {
-	return &MarkdownParser{
-		buffer: &strings.Builder{},
+	p := &MarkdownParser{
+		buffer:       &strings.Builder{},
+		longLine:     &strings.Builder{},
+		headingColor: tcell.ColorYellow,
 	}
+	p.Reset()
+	return p
 }
 
 func (p *MarkdownParser) Reset() {
 	p.inBold = false
 	p.inItalic = false
+	p.inUnderline = false
+	p.inStrike = false
 	p.inCode = false
-	p.inQuote = false
 	p.inList = false
+	p.inOrdered = false
+	p.heading = 0
+	p.taskDone = false
+	p.listIndents = nil
+	p.pending = ""
+	p.lineOpen = false
+	p.lineLength = 0
+	p.lineVerbatim = false
+	p.longLine.Reset()
+	p.prevLineEmpty = true
+	p.tableRows = nil
+	p.inCodeBlock = false
+	p.codeLang = ""
+	p.codeLines = nil
+	p.tagRun = -1
+	p.tagBrackets = false
+	p.widthUsed = false
+	p.column = p.startColumn
+	p.wrapPending = ""
+	p.wrapWord = false
 	p.buffer.Reset()
 }
 
 // RenderMarkdown renders complete text
 func (p *MarkdownParser) RenderMarkdown(text string) []byte {
-	return p.renderInternal(text, false)
+	p.Reset()
+	output := p.RenderPartial(text)
+	return append(output, p.Flush()...)
 }
 
-// RenderPartial renders text incrementally (for streaming)
+// RenderPartial renders the next chunk of a streamed response. Call Reset
+// before the first chunk and Flush after the last one.
 func (p *MarkdownParser) RenderPartial(text string) []byte {
-	return p.renderInternal(text, true)
+	return []byte(p.wrap(string(p.renderInternal(text)), false))
 }
 
-func (p *MarkdownParser) renderInternal(text string, partial bool) []byte {
-	p.partialMode = partial
-	p.Reset()
-	lines := strings.Split(text, "\n")
-	output := &strings.Builder{}
-	prevLineEmpty := true
+// Flush renders whatever is still held back and ends the current line
+func (p *MarkdownParser) Flush() []byte {
+	return []byte(p.wrap(string(p.flushInternal()), true))
+}
 
-	for i, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		lineEmpty := trimmed == ""
+// layoutWidth returns the width rules and tables are laid out to, 0 if unknown
+func (p *MarkdownParser) layoutWidth() int {
+	if p.wrapWidth > 0 && (p.width == 0 || p.wrapWidth < p.width) {
+		return p.wrapWidth
+	}
+	return p.width
+}
 
-		// Skip consecutive empty lines in partial mode
-		if lineEmpty && prevLineEmpty && partial {
-			continue
-		}
-		prevLineEmpty = lineEmpty
+// wrap breaks rendered output into lines of at most wrapWidth columns at the
+// spaces between words. A word wider than a line is left for the view to wrap.
+// Unless final is set, the last word is held back while it still fits on the
+// line since it may continue in the next output.
+func (p *MarkdownParser) wrap(output string, final bool) string {
+	if p.wrapWidth <= 0 {
+		return output
+	}
+	text := p.wrapPending + output
+	p.wrapPending = ""
 
-		if strings.HasPrefix(trimmed, "```") {
-			continue
+	out := &strings.Builder{}
+	for len(text) > 0 {
+		end := strings.IndexAny(text, " \n")
+		if end < 0 {
+			end = len(text)
 		}
 
-		if strings.HasPrefix(trimmed, "|") && strings.Contains(trimmed, "|") {
-			// Handle tables
-			if i > 0 && strings.HasPrefix(strings.TrimSpace(lines[i-1]), "|") {
-				p.buffer.Reset()
-				cells := strings.Split(trimmed, "|")
-				for _, cell := range cells {
-					cell = strings.TrimSpace(cell)
-					if cell != "" {
-						fmt.Fprintf(p.buffer, "[::b]%s[::-] ", cell)
-					}
+		// Rendered tags never contain spaces, so a word holds whole tags
+		word := text[:end]
+		width := tview.TaggedStringWidth(word)
+		overflow := p.column+width > p.wrapWidth
+		if end == len(text) && !final {
+			if !overflow {
+				p.wrapPending = word
+				break
+			}
+			// Once a word overflows, more of it can't change where it goes,
+			// so all but a bracket that may still become a tag is written
+			if cut := openTagStart(word); cut < len(word) {
+				p.wrapPending = word[cut:]
+				if cut == 0 {
+					break
 				}
-				output.WriteString(p.buffer.String() + "\n")
-			}
-		} else if strings.HasPrefix(trimmed, "> ") {
-			if !p.inQuote {
-				p.buffer.WriteString("[darkcyan]│ [::-]")
-				p.inQuote = true
-			}
-			content := filteredString(trimmed[2:])
-			p.markdownLine(content)
-			output.WriteString(p.buffer.String() + "\n")
-		} else if strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") {
-			if !p.inList {
-				p.buffer.WriteString(" • ")
-				p.inList = true
-			}
-			content := filteredString(trimmed[2:])
-			p.markdownLine(content)
-			output.WriteString(p.buffer.String() + "\n")
-		} else if lineEmpty {
-			if p.inList {
-				p.inList = false
-			}
-			if p.inQuote {
-				p.inQuote = false
-			}
-			output.WriteString("\n")
-		} else {
-			content := filteredString(line)
-			p.markdownLine(content)
-			output.WriteString(p.buffer.String() + "\n")
+				word = word[:cut]
+				width = tview.TaggedStringWidth(word)
+			}
 		}
-	}
+		if p.column > 0 && !p.wrapWord && width > 0 && overflow {
+			out.WriteByte('\n')
+			p.column = 0
+		}
+		out.WriteString(word)
+		p.column += width
+		p.wrapWord = true
+		if end == len(text) {
+			break
+		}
+		p.wrapWord = false
 
-	return []byte(output.String())
+		switch {
+		case text[end] == '\n':
+			out.WriteByte('\n')
+			p.column = 0
+		case p.column+1 > p.wrapWidth:
+			// The space falls at the end of a full line and becomes the break
+			out.WriteByte('\n')
+			p.column = 0
+		default:
+			out.WriteByte(' ')
+			p.column++
+		}
+		text = text[end+1:]
+	}
+	return out.String()
 }
 
-func filteredString(s string) string {
-	return strings.Map(func(r rune) rune {
-		if unicode.IsPrint(r) {
-			return r
+// maxTagLength bounds how far back openTagStart looks for a bracket
+const maxTagLength = 64
+
+// openTagStart returns where a trailing "[" that more text could still turn
+// into a tag or an escaped bracket starts in s, or len(s) if there is none
+func openTagStart(s string) int {
+	start := len(s)
+	for i := len(s) - 1; i >= 0 && i >= len(s)-maxTagLength; i-- {
+		if s[i] == '[' {
+			start = i
+		} else if !isTagChar(s[i]) {
+			break
 		}
-		return -1
-	}, s)
+	}
+	return start
 }
 
-func (p *MarkdownParser) markdownLine(line string) {
-	p.buffer.Reset()
-	active := false
+// flushInternal renders whatever is still held back and ends the current line
+func (p *MarkdownParser) flushInternal() []byte {
+	p.pending = p.longLine.String() + p.pending
+	p.longLine.Reset()
+	if p.raw {
+		output := rawText(p.pending) + "\n"
+		p.pending = ""
+		return []byte(output)
+	}
 
-	for i := 0; i < len(line); i++ {
-		if i > 0 && line[i-1] == '\\' {
-			continue
+	output := &strings.Builder{}
+	if p.lineOpen {
+		output.WriteString(p.finishLine(p.pending))
+	} else {
+		output.WriteString(p.renderLine(p.pending))
+	}
+	p.pending = ""
+
+	output.WriteString(p.flushTable())
+	// Flush an unclosed fence so its content isn't lost
+	if p.inCodeBlock {
+		output.WriteString(p.flushCodeBlock())
+	}
+	return []byte(output.String())
+}
+
+func (p *MarkdownParser) renderInternal(text string) []byte {
+	p.pending += text
+	if p.raw {
+		// Hold back an unclosed "[" so a tag split across chunks is still escaped
+		cut := len(p.pending)
+		if i := strings.LastIndexByte(p.pending, '['); i >= 0 && strings.IndexAny(p.pending[i:], "]\n") < 0 {
+			cut = i
 		}
+		output := rawText(p.pending[:cut])
+		p.pending = p.pending[cut:]
+		return []byte(output)
+	}
+	output := &strings.Builder{}
 
-		switch {
-		case strings.HasPrefix(line[i:], "**") && !p.inCode:
-			if active {
-				p.buffer.WriteString("[::-][white]")
-				active = false
-				i++
-			} else {
-				p.buffer.WriteString("[::b][white]")
-				active = true
-				i++
-			}
-		case strings.HasPrefix(line[i:], "__") && !p.inCode:
-			if active {
-				p.buffer.WriteString("[::-][white]")
-				active = false
-				i++
-			} else {
-				p.buffer.WriteString("[::u][white]")
-				active = true
-				i++
-			}
-		case line[i] == '*' && !p.inCode:
-			if active {
-				p.buffer.WriteString("[::-][white]")
-				active = false
-			} else {
-				p.buffer.WriteString("[::i][white]")
-				active = true
-			}
-		case line[i] == '_' && !p.inCode:
-			if active {
-				p.buffer.WriteString("[::-][white]")
-				active = false
-			} else {
-				p.buffer.WriteString("[::i][white]")
-				active = true
-			}
-		case strings.HasPrefix(line[i:], "`") && !p.inCode && !p.partialMode:
-			// Only handle code blocks in non-streaming mode
-			if !p.inCode {
-				p.buffer.WriteString("[::r]")
-				p.inCode = true
-				active = !active
-			} else {
-				p.buffer.WriteString("[::-][white]")
-				p.inCode = false
-				active = !active
-			}
-			i += 1
-		default:
-			p.buffer.WriteByte(line[i])
+	for {
+		idx := strings.IndexByte(p.pending, '\n')
+		if idx < 0 {
+			break
+		}
+		line := p.pending[:idx]
+		p.pending = p.pending[idx+1:]
+		if p.longLine.Len() > 0 {
+			line = p.longLine.String() + line
+			p.longLine.Reset()
+		}
+
+		if p.lineOpen {
+			output.WriteString(p.finishLine(line))
+		} else {
+			output.WriteString(p.renderLine(line))
 		}
 	}
 
-	if active {
-		p.buffer.WriteString("[::-]")
+	// Start the unfinished last line as soon as its block type is settled,
+	// then render as much of its inline content as is unambiguous
+	if !p.lineOpen && p.longLine.Len() == 0 && p.canOpenLine(p.pending) {
+		prefix, content := p.startLine(p.pending)
+		output.WriteString(prefix)
+		p.pending = content
+	}
+	if p.lineOpen {
+		// Past the verbatim point only trailing whitespace is held back
+		cut := len(strings.TrimRightFunc(p.pending, unicode.IsSpace))
+		if !p.lineVerbatim && (p.maxLineLength == 0 || p.lineLength+cut <= p.maxLineLength) {
+			cut = safeInlineCut(p.pending)
+		}
+		p.renderInline(p.pending[:cut])
+		output.WriteString(p.buffer.String())
+		p.pending = p.pending[cut:]
+	} else if p.longLine.Len() > 0 || p.maxLineLength > 0 && len(p.pending) > p.maxLineLength {
+		p.longLine.WriteString(p.pending)
+		p.pending = ""
 	}
-}
 
-type ChatUI struct {
-	app            *tview.Application
-	chatHistory    *tview.TextView
-	inputField     *tview.InputField
-	statusBar      *tview.TextView
-	loadingSpinner *tview.TextView
-	flex           *tview.Flex
-	client         *http.Client
-	cfg            *Config
-	messages       []Message
-	mu             sync.Mutex
-	loadingActive  bool
-	assistantText  *strings.Builder
-	markdownParser *MarkdownParser
+	return []byte(output.String())
 }
 
-func loadConfig() (*Config, error) {
-	v := viper.New()
-	v.SetConfigName("config")
-	v.SetConfigType("yaml")
-	v.AddConfigPath(".")
-	v.AddConfigPath("$HOME/.openrouter")
+// renderLine renders one complete line that hasn't been started yet
+func (p *MarkdownParser) renderLine(line string) string {
+	trimmed := strings.TrimSpace(line)
+	output := &strings.Builder{}
 
-	if err := v.ReadInConfig(); err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
+	if strings.HasPrefix(trimmed, "```") {
+		output.WriteString(p.flushTable())
+		if p.inCodeBlock {
+			output.WriteString(p.flushCodeBlock())
+		} else {
+			p.inCodeBlock = true
+			p.codeLang = strings.TrimSpace(strings.TrimPrefix(trimmed, "```"))
+		}
+		p.prevLineEmpty = false
+		return output.String()
 	}
 
-	v.SetDefault("openrouter.model", "openai/gpt-3.5-turbo")
-	v.SetDefault("openrouter.timeout", 30)
-	v.SetDefault("openrouter.max_tokens", 512)
-
-	var cfg Config
-	if err := v.Unmarshal(&cfg); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	// Lines inside a fence are kept verbatim until the closing fence
+	if p.inCodeBlock {
+		p.codeLines = append(p.codeLines, line)
+		return ""
 	}
 
-	// Validate API key
-	if cfg.OpenRouter.APIKey == "" || cfg.OpenRouter.APIKey == "your-api-key-here" {
-		return nil, fmt.Errorf("API key is not configured. Please update config.yaml")
+	if strings.HasPrefix(trimmed, "|") {
+		p.tableRows = append(p.tableRows, line)
+		p.prevLineEmpty = false
+		return ""
 	}
+	output.WriteString(p.flushTable())
 
-	return &cfg, nil
-}
+	if trimmed == "" {
+		if p.prevLineEmpty && p.collapseBlankLines {
+			return output.String()
+		}
+		p.prevLineEmpty = true
+		p.inList = false
+		p.inOrdered = false
+		output.WriteString("\n")
+		return output.String()
+	}
 
-func NewChatUI(cfg *Config) *ChatUI {
-	return &ChatUI{
-		app:            tview.NewApplication(),
-		cfg:            cfg,
-		messages:       []Message{},
-		markdownParser: NewMarkdownParser(),
-		client: &http.Client{
-			Timeout: time.Duration(cfg.OpenRouter.Timeout) * time.Second,
-		},
+	if ruleLinePattern.MatchString(trimmed) {
+		p.prevLineEmpty = false
+		p.inList = false
+		p.inOrdered = false
+		p.listIndents = nil
+		width := ruleWidth
+		if w := p.layoutWidth(); w > 0 {
+			width = w
+		}
+		p.widthUsed = true
+		fmt.Fprintf(output, "[gray]%s[-]\n", strings.Repeat("─", width))
+		return output.String()
 	}
+
+	prefix, content := p.startLine(line)
+	output.WriteString(prefix)
+	output.WriteString(p.finishLine(content))
+	return output.String()
 }
 
-func (ui *ChatUI) SetupUI() {
-	ui.chatHistory = tview.NewTextView().
-		SetDynamicColors(true).
-		SetRegions(true).
-		SetWordWrap(true).
-		SetScrollable(true).
-		SetChangedFunc(func() {
-			ui.app.Draw()
-		})
-	ui.chatHistory.SetBorder(true).SetTitle(" Conversation ").SetBorderColor(tcell.ColorBlue)
-	ui.chatHistory.SetText("Welcome to OpenRouter Chat!\nEnter your message below and press Enter to send.")
+// canOpenLine reports whether an unfinished line can be started before its
+// newline arrives, i.e. more text can no longer change how it is rendered
+func (p *MarkdownParser) canOpenLine(line string) bool {
+	if p.inCodeBlock {
+		return false
+	}
 
-	ui.loadingSpinner = tview.NewTextView()
-	ui.loadingSpinner.SetTextAlign(tview.AlignCenter)
+	trimmed := strings.TrimLeftFunc(line, unicode.IsSpace)
+	if trimmed == "" {
+		return false
+	}
 
-	ui.inputField = tview.NewInputField().
-		SetLabel("You: ").
-		SetFieldWidth(0).
-		SetFieldBackgroundColor(tcell.ColorBlack)
-	ui.inputField.SetBorder(true).SetTitle(" Input ").SetTitleAlign(tview.AlignLeft).SetBorderColor(tcell.ColorGreen)
+	// A run of one marker could still become a horizontal rule
+	if c := trimmed[0]; strings.IndexByte("-*_", c) >= 0 &&
+		strings.Trim(trimmed, string(c)+" \t") == "" {
+		return false
+	}
 
-	ui.statusBar = tview.NewTextView()
-	ui.statusBar.SetTextAlign(tview.AlignRight).SetTextColor(tcell.ColorYellow)
-	ui.UpdateStatus(fmt.Sprintf("Model: %s | Status: Ready", ui.cfg.OpenRouter.Model))
+	switch c := trimmed[0]; {
+	case c == '|':
+		return false
+	case c == '`':
+		// Could still turn out to be a fence
+		return !strings.HasPrefix("```", trimmed) && !strings.HasPrefix(trimmed, "```")
+	case c == '>':
+		// Wait for the content so nested markers are all counted
+		return strings.Trim(trimmed, "> \t") != ""
+	case c == '-' || c == '*':
+		return len(trimmed) >= 2 && !pendingTaskPattern.MatchString(trimmed)
+	case c == '#':
+		return !pendingHeadingPattern.MatchString(trimmed)
+	case c >= '0' && c <= '9':
+		return !pendingOrderedPattern.MatchString(trimmed)
+	}
+	return true
+}
 
-	ui.flex = tview.NewFlex().
-		SetDirection(tview.FlexRow).
-		AddItem(ui.chatHistory, 0, 1, false).
-		AddItem(ui.loadingSpinner, 1, 0, false).
-		AddItem(ui.inputField, 3, 1, true).
-		AddItem(ui.statusBar, 1, 1, false)
+// startLine writes the block-level markup of a content line (quote, list
+// item or paragraph) and returns it along with the inline content that follows
+func (p *MarkdownParser) startLine(line string) (prefix, content string) {
+	output := &strings.Builder{}
+	output.WriteString(p.flushTable())
+	p.prevLineEmpty = false
+	p.lineOpen = true
+	trimmed := strings.TrimLeftFunc(line, unicode.IsSpace)
 
-	ui.inputField.SetDoneFunc(func(key tcell.Key) {
-		if key == tcell.KeyEnter {
-			text := ui.inputField.GetText()
-			if text != "" {
-				ui.handleInput(text)
+	if m := headingPattern.FindStringSubmatch(trimmed); m != nil {
+		p.inOrdered = false
+		p.listIndents = nil
+		p.heading = len(m[1])
+		output.WriteString(p.headingTag(p.heading))
+		content = m[2]
+	} else if depth, rest := quoteDepth(trimmed); depth > 0 {
+		p.inOrdered = false
+		p.listIndents = nil
+		output.WriteString(strings.Repeat("[darkcyan]│[-] ", depth))
+		content = rest
+	} else if m := orderedListPattern.FindStringSubmatch(trimmed); m != nil {
+		p.inOrdered = true
+		p.inList = false
+		depth := p.listDepth(indentWidth(line))
+		fmt.Fprintf(output, "%s [::b]%s.[::-] ", strings.Repeat("  ", depth), m[1])
+		content = m[2]
+	} else if strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") {
+		p.inOrdered = false
+		p.inList = true
+		depth := p.listDepth(indentWidth(line))
+		content = trimmed[2:]
+		// The checkbox of a task takes the place of the bullet
+		bullet := bulletGlyphs[depth%len(bulletGlyphs)]
+		if m := taskPattern.FindStringSubmatch(content); m != nil {
+			bullet = "☐"
+			if m[1] != " " {
+				p.taskDone = true
+				bullet = "[::d]☑"
 			}
-			ui.inputField.SetText("")
+			content = content[len(m[0]):]
 		}
-	})
+		fmt.Fprintf(output, "%s %s ", strings.Repeat("  ", depth), bullet)
+	} else {
+		p.inOrdered = false
+		p.listIndents = nil
+		content = line
+	}
+	return output.String(), content
+}
 
+// quoteDepth returns how many ">" markers a line is quoted with, and the
+// content after them
+func quoteDepth(line string) (depth int, content string) {
+	for {
+		rest := strings.TrimLeft(line, " \t")
+		if !strings.HasPrefix(rest, ">") {
+			return depth, line
+		}
+		depth++
+		line = strings.TrimPrefix(rest[1:], " ")
+	}
+}
+
+// bulletGlyphs are the list bullets, alternating with the nesting depth
+var bulletGlyphs = []string{"•", "◦", "▪"}
+
+// indentWidth returns the width of the leading whitespace of a line, counting
+// a tab as four columns
+func indentWidth(line string) int {
+	width := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			width++
+		case '\t':
+			width += 4
+		default:
+			return width
+		}
+	}
+	return width
+}
+
+// listDepth returns the nesting depth of a list item indented by indent
+// columns. Items indented deeper than the enclosing item are nested in it.
+func (p *MarkdownParser) listDepth(indent int) int {
+	for len(p.listIndents) > 0 && p.listIndents[len(p.listIndents)-1] > indent {
+		p.listIndents = p.listIndents[:len(p.listIndents)-1]
+	}
+	if len(p.listIndents) == 0 || p.listIndents[len(p.listIndents)-1] < indent {
+		p.listIndents = append(p.listIndents, indent)
+	}
+	return len(p.listIndents) - 1
+}
+
+// finishLine renders the remaining content of the open line and ends it
+func (p *MarkdownParser) finishLine(rest string) string {
+	p.renderInline(strings.TrimRightFunc(rest, unicode.IsSpace))
+	p.lineOpen = false
+	p.lineLength = 0
+	p.lineVerbatim = false
+	output := p.buffer.String() + p.closeInline()
+	if p.heading > 0 {
+		output += "[-::-]"
+		p.heading = 0
+	}
+	if p.taskDone {
+		output += "[::D]"
+		p.taskDone = false
+	}
+	return output + "\n"
+}
+
+// renderInline renders the next piece of the open line into p.buffer, with
+// markup up to maxLineLength bytes into the line and verbatim past that
+func (p *MarkdownParser) renderInline(text string) {
+	head := len(text)
+	if p.lineVerbatim {
+		head = 0
+	} else if p.maxLineLength > 0 && p.lineLength+len(text) > p.maxLineLength {
+		head = p.maxLineLength - p.lineLength
+		for head > 0 && !utf8.RuneStart(text[head]) {
+			head--
+		}
+		p.lineVerbatim = true
+	}
+	p.lineLength += len(text)
+
+	p.markdownLine(filteredString(text[:head]))
+	rest := filteredString(text[head:])
+	for i := 0; i < len(rest); i++ {
+		p.writeText(rest[i])
+	}
+}
+
+// headingTag returns the style of a heading, with more weight for H1 and H2
+func (p *MarkdownParser) headingTag(level int) string {
+	switch level {
+	case 1:
+		return fmt.Sprintf("[%s::bu]", p.headingColor)
+	case 2:
+		return fmt.Sprintf("[%s::b]", p.headingColor)
+	}
+	return "[::b]"
+}
+
+// safeInlineCut returns how much of an unfinished line can be rendered now.
+// Trailing markers and whitespace are held back since their meaning depends
+// on what follows (e.g. "*" vs "**", or trailing spaces trimmed at line end).
+// So is a link or image whose closing parenthesis hasn't arrived yet.
+func safeInlineCut(s string) int {
+	cut := len(s)
+	for i := 0; i < len(s); i++ {
+		if s[i] == '[' && pendingLinkPattern.MatchString(s[i:]) ||
+			s[i] == '!' && pendingImagePattern.MatchString(s[i:]) {
+			cut = i
+			break
+		}
+	}
+	for cut > 0 && strings.IndexByte("*_~!\\ \t", s[cut-1]) >= 0 {
+		cut--
+	}
+	return cut
+}
+
+// flushTable renders the buffered table rows, if any
+func (p *MarkdownParser) flushTable() string {
+	if len(p.tableRows) == 0 {
+		return ""
+	}
+	output := p.renderTable(p.tableRows)
+	p.tableRows = nil
+	return output
+}
+
+// splitTableRow splits a "| a | b |" row into its trimmed cells
+func splitTableRow(row string) []string {
+	row = strings.TrimSpace(row)
+	row = strings.TrimPrefix(row, "|")
+	row = strings.TrimSuffix(row, "|")
+
+	cells := strings.Split(row, "|")
+	for i, cell := range cells {
+		cells[i] = strings.TrimSpace(cell)
+	}
+	return cells
+}
+
+// isTableSeparator reports whether cells form a "|---|:--:|" separator row
+func isTableSeparator(cells []string) bool {
+	for _, cell := range cells {
+		if !tableSeparatorPattern.MatchString(cell) {
+			return false
+		}
+	}
+	return true
+}
+
+// renderTable renders a block of table rows with columns padded to the widest
+// cell. The first row is bold when it is followed by a separator row. Padding
+// is dropped when the aligned table would not fit the view width.
+func (p *MarkdownParser) renderTable(rows []string) string {
+	var (
+		rendered [][]string
+		widths   []int
+		header   bool
+	)
+	for i, row := range rows {
+		cells := splitTableRow(row)
+		if isTableSeparator(cells) {
+			header = i == 1
+			continue
+		}
+
+		formatted := make([]string, len(cells))
+		for j, cell := range cells {
+			p.renderInline(cell)
+			p.lineLength = 0
+			p.lineVerbatim = false
+			formatted[j] = p.buffer.String() + p.closeInline()
+			if j >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := tview.TaggedStringWidth(formatted[j]); w > widths[j] {
+				widths[j] = w
+			}
+		}
+		rendered = append(rendered, formatted)
+	}
+
+	total := 0
+	for j, w := range widths {
+		if j > 0 {
+			total += 3
+		}
+		total += w
+	}
+	pad := p.layoutWidth() == 0 || total <= p.layoutWidth()
+	p.widthUsed = true
+
+	out := &strings.Builder{}
+	for i, cells := range rendered {
+		for j, cell := range cells {
+			if j > 0 {
+				out.WriteString(" [gray]│[-] ")
+			}
+			if i == 0 && header {
+				cell = "[::b]" + cell + "[::-]"
+			}
+			out.WriteString(cell)
+			if pad && j < len(cells)-1 {
+				out.WriteString(strings.Repeat(" ", widths[j]-tview.TaggedStringWidth(cell)))
+			}
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// flushCodeBlock renders the buffered code block verbatim in reverse video,
+// padding every line to the widest one so the block reads as a rectangle
+func (p *MarkdownParser) flushCodeBlock() string {
+	out := &strings.Builder{}
+	if p.codeLang != "" {
+		fmt.Fprintf(out, "[gray]%s[-]\n", tview.Escape(filteredString(p.codeLang)))
+	}
+
+	raw := make([]string, len(p.codeLines))
+	lines := make([]string, len(p.codeLines))
+	width := 0
+	for i, line := range p.codeLines {
+		raw[i] = filteredString(strings.ReplaceAll(line, "\t", "    "))
+		lines[i] = tview.Escape(raw[i])
+		// The block isn't padded out to a line too long to render with markup
+		if p.maxLineLength > 0 && len(line) > p.maxLineLength {
+			continue
+		}
+		if w := tview.TaggedStringWidth(lines[i]); w > width {
+			width = w
+		}
+	}
+
+	// Known languages are highlighted on a dark background, anything else
+	// is shown plain in reverse video
+	var lang *codeLanguage
+	if fields := strings.Fields(p.codeLang); len(fields) > 0 {
+		lang = codeLanguages[strings.ToLower(fields[0])]
+	}
+	var state codeState
+	for i, line := range lines {
+		padding := strings.Repeat(" ", max(width-tview.TaggedStringWidth(line), 0))
+		if lang != nil {
+			fmt.Fprintf(out, "[%s:%s] %s%s [-:-:-]\n", codeText, codeBackground, lang.highlight(raw[i], &state), padding)
+		} else {
+			fmt.Fprintf(out, "[::r] %s%s [::-]\n", line, padding)
+		}
+	}
+
+	p.inCodeBlock = false
+	p.codeLang = ""
+	p.codeLines = nil
+	return out.String()
+}
+
+// Colors of highlighted code blocks
+const (
+	codeText       = "#d0d0d0"
+	codeBackground = "#262626"
+	codeKeyword    = "orange"
+	codeString     = "lightgreen"
+	codeComment    = "gray"
+)
+
+// codeLanguage describes what is highlighted in code blocks of a language
+type codeLanguage struct {
+	keywords     map[string]bool
+	lineComment  string    // Starts a comment to the end of the line, "" for none
+	blockComment [2]string // Opens and closes a comment, empty for none
+	quotes       string    // Characters that delimit strings
+	rawQuotes    string    // Quotes of strings that may span lines, without escapes
+}
+
+// codeState is carried from one line of a code block to the next
+type codeState struct {
+	inComment bool // In an unclosed block comment
+	inString  byte // Quote of an unclosed raw string, 0 outside of one
+}
+
+// newCodeLanguage returns a language highlighting the space separated keywords
+func newCodeLanguage(keywords, lineComment string, blockComment [2]string, quotes, rawQuotes string) *codeLanguage {
+	lang := &codeLanguage{
+		keywords:     map[string]bool{},
+		lineComment:  lineComment,
+		blockComment: blockComment,
+		quotes:       quotes,
+		rawQuotes:    rawQuotes,
+	}
+	for _, keyword := range strings.Fields(keywords) {
+		lang.keywords[keyword] = true
+	}
+	return lang
+}
+
+var (
+	goLanguage = newCodeLanguage("break case chan const continue default defer else fallthrough for func go goto "+
+		"if import interface map package range return select struct switch type var true false nil iota",
+		"//", [2]string{"/*", "*/"}, "\"'`", "`")
+	pythonLanguage = newCodeLanguage("and as assert async await break class continue def del elif else except "+
+		"finally for from global if import in is lambda nonlocal not or pass raise return try while with yield "+
+		"None True False",
+		"#", [2]string{}, "\"'", "")
+	jsLanguage = newCodeLanguage("async await break case catch class const continue debugger default delete do "+
+		"else enum export extends finally for function if implements import in instanceof interface let new of "+
+		"return super switch this throw try type typeof var void while with yield true false null undefined",
+		"//", [2]string{"/*", "*/"}, "\"'`", "`")
+	rustLanguage = newCodeLanguage("as async await break const continue crate dyn else enum extern fn for if impl "+
+		"in let loop match mod move mut pub ref return self Self static struct super trait type unsafe use where "+
+		"while true false",
+		"//", [2]string{"/*", "*/"}, "\"", "")
+	shellLanguage = newCodeLanguage("if then else elif fi for while until do done case esac in function return "+
+		"local export",
+		"#", [2]string{}, "\"'", "")
+)
+
+// codeLanguages maps the language tag of a fence to its highlighting
+var codeLanguages = map[string]*codeLanguage{
+	"go":         goLanguage,
+	"golang":     goLanguage,
+	"python":     pythonLanguage,
+	"py":         pythonLanguage,
+	"javascript": jsLanguage,
+	"js":         jsLanguage,
+	"jsx":        jsLanguage,
+	"typescript": jsLanguage,
+	"ts":         jsLanguage,
+	"tsx":        jsLanguage,
+	"rust":       rustLanguage,
+	"rs":         rustLanguage,
+	"sh":         shellLanguage,
+	"bash":       shellLanguage,
+	"shell":      shellLanguage,
+	"zsh":        shellLanguage,
+}
+
+// highlight colors the keywords, strings and comments of one line of code.
+// state carries unclosed block comments and raw strings to the next line.
+func (lang *codeLanguage) highlight(line string, state *codeState) string {
+	out := &strings.Builder{}
+	plain := &strings.Builder{}
+	write := func(text, color string) {
+		if color == "" {
+			plain.WriteString(text)
+			return
+		}
+		out.WriteString(tview.Escape(plain.String()))
+		plain.Reset()
+		fmt.Fprintf(out, "[%s]%s[%s]", color, tview.Escape(text), codeText)
+	}
+
+	for i := 0; i < len(line); {
+		rest := line[i:]
+		switch {
+		case state.inComment:
+			end := strings.Index(rest, lang.blockComment[1])
+			if end < 0 {
+				write(rest, codeComment)
+				i = len(line)
+				break
+			}
+			end += len(lang.blockComment[1])
+			write(rest[:end], codeComment)
+			state.inComment = false
+			i += end
+		case state.inString != 0:
+			end := strings.IndexByte(rest, state.inString)
+			if end < 0 {
+				write(rest, codeString)
+				i = len(line)
+				break
+			}
+			write(rest[:end+1], codeString)
+			state.inString = 0
+			i += end + 1
+		case lang.lineComment != "" && strings.HasPrefix(rest, lang.lineComment):
+			write(rest, codeComment)
+			i = len(line)
+		case lang.blockComment[0] != "" && strings.HasPrefix(rest, lang.blockComment[0]):
+			write(lang.blockComment[0], codeComment)
+			state.inComment = true
+			i += len(lang.blockComment[0])
+		case strings.IndexByte(lang.quotes, rest[0]) >= 0:
+			quote := rest[0]
+			if strings.IndexByte(lang.rawQuotes, quote) >= 0 {
+				write(rest[:1], codeString)
+				state.inString = quote
+				i++
+				break
+			}
+			end := 1
+			for end < len(rest) && rest[end] != quote {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(rest))
+			write(rest[:end], codeString)
+			i += end
+		case rest[0] == '_' || rest[0] < utf8.RuneSelf && unicode.IsLetter(rune(rest[0])):
+			end := 1
+			for end < len(rest) && (rest[end] == '_' || rest[end] < utf8.RuneSelf &&
+				(unicode.IsLetter(rune(rest[end])) || unicode.IsDigit(rune(rest[end])))) {
+				end++
+			}
+			color := ""
+			if lang.keywords[rest[:end]] {
+				color = codeKeyword
+			}
+			write(rest[:end], color)
+			i += end
+		default:
+			write(rest[:1], "")
+			i++
+		}
+	}
+	out.WriteString(tview.Escape(plain.String()))
+	return out.String()
+}
+
+// rawText escapes text for the chat view without rendering markdown
+func rawText(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = tview.Escape(filteredString(strings.ReplaceAll(line, "\t", "    ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatJSON pretty-prints text as highlighted JSON for the chat view. A
+// surrounding code fence is ignored; ok is false when text isn't valid JSON.
+func formatJSON(text string) (formatted string, ok bool) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") && strings.HasSuffix(text, "```") && len(text) > 6 {
+		text = strings.TrimSuffix(text, "```")
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = strings.TrimSpace(text[i+1:])
+		}
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(text), "", "  "); err != nil {
+		return "", false
+	}
+
+	lines := strings.Split(indented.String(), "\n")
+	for i, line := range lines {
+		lines[i] = filteredString(line)
+	}
+	src := strings.Join(lines, "\n")
+	out := &strings.Builder{}
+	for i := 0; i < len(src); {
+		switch c := src[i]; {
+		case c == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(src))
+			// A string followed by a colon is an object key
+			color := "green"
+			if strings.HasPrefix(strings.TrimLeft(src[end:], " "), ":") {
+				color = "darkcyan"
+			}
+			fmt.Fprintf(out, "[%s]%s[-]", color, tview.Escape(src[i:end]))
+			i = end
+		case c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z':
+			end := i + 1
+			for end < len(src) && strings.IndexByte("+-.eE0123456789abcdefghijklmnopqrstuvwxyz", src[end]) >= 0 {
+				end++
+			}
+			fmt.Fprintf(out, "[yellow]%s[-]", src[i:end])
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String(), true
+}
+
+func filteredString(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// markdownLine renders the inline markup of a line, or a piece of one, into
+// p.buffer. Open styles are tracked on the parser so the rest of the line can
+// be rendered by a later call.
+func (p *MarkdownParser) markdownLine(line string) {
+	p.buffer.Reset()
+
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && !p.inCode &&
+			strings.IndexByte(markdownEscapable, line[i+1]) >= 0:
+			i++
+			p.writeText(line[i])
+		case line[i] == '`':
+			p.inCode = !p.inCode
+			p.writeTag(styleTag('r', p.inCode))
+		case p.inCode:
+			p.writeText(line[i])
+		case line[i] == '!' && imagePattern.MatchString(line[i:]):
+			m := imagePattern.FindStringSubmatch(line[i:])
+			p.writeImage(m[1], m[2])
+			i += len(m[0]) - 1
+		case line[i] == '[' && linkPattern.MatchString(line[i:]):
+			m := linkPattern.FindStringSubmatch(line[i:])
+			p.writeLink(m[1], m[2])
+			i += len(m[0]) - 1
+		case strings.HasPrefix(line[i:], "**"):
+			p.inBold = !p.inBold
+			// Headings are bold throughout
+			if p.heading == 0 {
+				p.writeTag(styleTag('b', p.inBold))
+			}
+			i++
+		case strings.HasPrefix(line[i:], "__"):
+			p.inUnderline = !p.inUnderline
+			p.writeTag(styleTag('u', p.inUnderline))
+			i++
+		case strings.HasPrefix(line[i:], "~~"):
+			p.inStrike = !p.inStrike
+			p.writeTag(styleTag('s', p.inStrike))
+			i++
+		case line[i] == '*' || line[i] == '_':
+			p.inItalic = !p.inItalic
+			p.writeTag(styleTag('i', p.inItalic))
+		default:
+			p.writeText(line[i])
+		}
+	}
+}
+
+// writeText writes one byte of model text to p.buffer. A "]" that would
+// close something tview reads as a tag, such as "[red]", is escaped the way
+// tview.Escape does it, even when the text arrives split across chunks.
+func (p *MarkdownParser) writeText(c byte) {
+	switch {
+	case c == '[':
+		p.tagBrackets = p.tagBrackets || p.tagRun > 0
+		p.tagRun = 0
+	case c == ']' && (p.tagRun > 0 || p.tagBrackets):
+		p.buffer.WriteByte('[')
+		p.tagRun = -1
+		p.tagBrackets = false
+	case p.tagRun >= 0 && isTagChar(c):
+		p.tagRun++
+		p.tagBrackets = false
+	default:
+		p.tagRun = -1
+		p.tagBrackets = false
+	}
+	p.buffer.WriteByte(c)
+}
+
+// writeLink writes a link as its text followed by the URL, which is kept
+// visible since terminals can't follow links
+func (p *MarkdownParser) writeLink(text, url string) {
+	p.writeTag("[blue]")
+	for i := 0; i < len(text); i++ {
+		p.writeText(text[i])
+	}
+	p.writeTag("[-] [gray](")
+	for i := 0; i < len(url); i++ {
+		p.writeText(url[i])
+	}
+	p.writeTag(")[-]")
+}
+
+// writeImage writes a placeholder for an image, which can't be shown inline,
+// with its alt text and URL
+func (p *MarkdownParser) writeImage(alt, url string) {
+	if alt == "" {
+		alt = "image"
+	}
+	p.writeLink("🖼 "+alt, url)
+}
+
+// writeTag writes one of the renderer's own tags, which ends any tag-like
+// run in the model text
+func (p *MarkdownParser) writeTag(tag string) {
+	p.tagRun = -1
+	p.tagBrackets = false
+	p.buffer.WriteString(tag)
+}
+
+// isTagChar reports whether c may appear between the brackets of a tview tag
+func isTagChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte(`_,;: -."#`, c) >= 0
+}
+
+// markdownEscapable lists the characters a backslash escapes
+const markdownEscapable = "\\`*_{}[]()#+-.!|>~"
+
+// styleTag returns the tview tag that turns a text attribute on or off
+func styleTag(attr byte, on bool) string {
+	if !on {
+		attr -= 'a' - 'A'
+	}
+	return "[::" + string(attr) + "]"
+}
+
+// closeInline ends any inline style left open at the end of a line
+func (p *MarkdownParser) closeInline() string {
+	open := p.inBold || p.inItalic || p.inUnderline || p.inStrike || p.inCode
+	p.inBold = false
+	p.inItalic = false
+	p.inUnderline = false
+	p.inStrike = false
+	p.inCode = false
+	p.tagRun = -1
+	p.tagBrackets = false
+	if open {
+		return "[::-]"
+	}
+	return ""
+}
+
+type ChatUI struct {
+	app            *tview.Application
+	chatHistory    *tview.TextView
+	inputField     *tview.InputField
+	statusBar      *tview.TextView
+	loadingSpinner *tview.TextView
+	flex           *tview.Flex
+	pages          *tview.Pages
+	client         *http.Client         // Client for the current model
+	clients        map[int]*http.Client // Clients by seconds to wait for response headers
+	cfg            *Config
+	messages       []Message
+	mu             sync.Mutex
+	keyIndex       atomic.Uint32 // Rotates the API key each request starts with
+	loadingActive  bool
+	loadingStart   time.Time     // When the current request was sent
+	lastDuration   time.Duration // How long the last request took
+	cancelRequest  context.CancelFunc
+	quitting       bool // Waiting for a cancelled request before exiting
+	assistantText  *strings.Builder
+	reasoningOpen  bool   // A reasoning trace is being streamed
+	reasoningTail  string // Reasoning text held back until a tag can be escaped
+	answerStart    int    // Where the streamed answer starts in the chat view, -1 before it does
+	continuation   string // Response the request in flight continues, "" unless it came from /continue
+	headerLen      int    // Length of the system prompt header topping the chat view
+	systemExpanded bool   // The system prompt header shows the whole prompt
+	markdownParser *MarkdownParser
+	theme          Theme
+	noWrap         bool  // Long lines run off the view instead of wrapping
+	widthDependent bool  // The chat view holds rules or tables laid out to its width
+	messageOffsets []int // Where each message shown in the chat view starts in its text
+	historyPath    string
+	inputHistory   []string    // Submitted inputs recalled with Up/Down, oldest first
+	inputIndex     int         // Recalled entry, len(inputHistory) when not browsing
+	inputDraft     string      // Text typed before browsing started
+	inputPath      string      // Where the input history is kept, if save_input_history is set
+	sessionsDir    string      // Where /save and /load keep named conversations
+	pendingImages  []string    // Data URLs attached to the next user message
+	models         []ModelInfo // Cached models list, fetched on first use
+	lastUsage      *Usage      // Token usage of the last exchange, if reported
+	lastProvider   string      // Upstream provider of the last response, if reported
+	lastModel      string      // Model that served the last response, if reported
+	rateLimit      *RateLimit  // Request budget reported with the last response, if any
+	startupPrompt  string      // Sent as the first message once the UI runs, from -prompt-file
+	startupSystem  string      // System prompt from -system, kept over a restored conversation's
+
+	// Scrollback search state
+	searchText    string // Chat text before match regions were inserted
+	searchMatches int
+	searchIndex   int
+}
+
+// defaultConfigFile is where the config is created on first run
+const defaultConfigFile = "config.yaml"
+
+// defaultModel is used when the config doesn't name a model
+const defaultModel = "openai/gpt-3.5-turbo"
+
+// promptConfig asks for the API key and model of a new config on the terminal
+func promptConfig(in io.Reader, out io.Writer) (apiKey, model string, err error) {
+	scanner := bufio.NewScanner(in)
+	ask := func(question string) (string, error) {
+		fmt.Fprint(out, question)
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", fmt.Errorf("failed to read input: %w", err)
+			}
+			return "", fmt.Errorf("input ended before the setup was complete")
+		}
+		return strings.TrimSpace(scanner.Text()), nil
+	}
+
+	fmt.Fprintln(out, "No config file found, let's create one.")
+	fmt.Fprintln(out, "You can get your API key at: https://openrouter.ai/keys")
+	for apiKey == "" {
+		if apiKey, err = ask("OpenRouter API key: "); err != nil {
+			return "", "", err
+		}
+	}
+	for {
+		if model, err = ask(fmt.Sprintf("Model [%s]: ", defaultModel)); err != nil {
+			return "", "", err
+		}
+		if model == "" {
+			model = defaultModel
+		}
+		if modelSlugPattern.MatchString(model) {
+			return apiKey, model, nil
+		}
+		fmt.Fprintf(out, "Invalid model %q, expected provider/name\n", model)
+	}
+}
+
+// writeConfig creates a config file at path with the given key and model.
+// It is only readable by the user since it holds the key.
+func writeConfig(path, apiKey, model string) error {
+	v := viper.New()
+	v.SetConfigPermissions(0o600)
+	v.Set("openrouter", map[string]interface{}{
+		"api_key":    apiKey,
+		"model":      model,
+		"timeout":    30,
+		"max_tokens": 512,
+		"stream":     true,
+	})
+	return v.WriteConfigAs(path)
+}
+
+// xdgConfigDir returns the XDG config directory of the app, falling back to
+// ~/.config/openrouter when $XDG_CONFIG_HOME is unset
+func xdgConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "openrouter")
+	}
+	return filepath.Join("$HOME", ".config", "openrouter")
+}
+
+// defaultBaseURL is the root of the OpenRouter API
+const defaultBaseURL = "https://openrouter.ai/api/v1"
+
+// maxStopSequences is how many stop sequences the API accepts
+const maxStopSequences = 4
+
+// promptPlaceholder marks where prompt_template takes the user's message
+const promptPlaceholder = "{input}"
+
+// supportedTransforms are the prompt transforms OpenRouter offers. "middle-out"
+// drops or truncates messages from the middle of a prompt too long for the
+// model's context.
+var supportedTransforms = []string{"middle-out"}
+
+// bindEnvKeys binds the key of each field of t, a config struct, to its
+// environment variable. Nested structs are walked, maps are left to the
+// config file.
+func bindEnvKeys(v *viper.Viper, t reflect.Type, prefix string) error {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		switch fieldType.Kind() {
+		case reflect.Struct:
+			if err := bindEnvKeys(v, fieldType, key+"."); err != nil {
+				return err
+			}
+		case reflect.Map:
+		default:
+			if err := v.BindEnv(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadConfig reads the config file at path, or searches the default
+// locations when path is empty. Offline mode needs neither a config file nor
+// an API key.
+func loadConfig(path string, offline bool) (*Config, error) {
+	v := viper.New()
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("config")
+		v.SetConfigType("yaml")
+		v.AddConfigPath(".")
+		v.AddConfigPath("$HOME/.openrouter")
+		v.AddConfigPath(xdgConfigDir())
+	}
+
+	// Environment variables override the config file, e.g. OPENROUTER_MODEL
+	// for openrouter.model. Every key is bound so it is picked up even when
+	// neither the config file nor a default mentions it.
+	v.SetEnvPrefix("openrouter")
+	v.SetEnvKeyReplacer(strings.NewReplacer("OPENROUTER.", "", ".", "_"))
+	v.AutomaticEnv()
+	if err := bindEnvKeys(v, reflect.TypeOf(Config{}), ""); err != nil {
+		return nil, fmt.Errorf("failed to bind environment: %w", err)
+	}
+
+	if err := v.ReadInConfig(); err != nil {
+		// A missing config file is fine as long as the key comes from the environment
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) || (v.GetString("openrouter.api_key") == "" && !offline) {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+	}
+
+	v.SetDefault("openrouter.base_url", defaultBaseURL)
+	v.SetDefault("openrouter.model", defaultModel)
+	v.SetDefault("openrouter.timeout", 30)
+	v.SetDefault("openrouter.idle_timeout", 30)
+	v.SetDefault("openrouter.connect_retries", 3)
+	v.SetDefault("openrouter.max_tokens", 512)
+	v.SetDefault("openrouter.system_prompt", "")
+	v.SetDefault("openrouter.show_reasoning", true)
+	v.SetDefault("openrouter.collapse_blank_lines", true)
+	v.SetDefault("openrouter.render_markdown", true)
+	v.SetDefault("openrouter.max_markdown_line_length", 10000)
+	v.SetDefault("openrouter.stream", true)
+	v.SetDefault("keybindings.quit", "Ctrl+C")
+	v.SetDefault("keybindings.send", "Enter")
+	// Clearing isn't confirmed, so it has no key unless one is configured
+	v.SetDefault("keybindings.clear", "")
+	v.SetDefault("keybindings.cancel", "Esc")
+	v.SetDefault("keybindings.copy", "Ctrl+Y")
+	v.SetDefault("keybindings.focus", "Tab")
+	// Nor is undoing, /undo does it without a stray keypress
+	v.SetDefault("keybindings.undo", "")
+	v.SetDefault("openrouter.spinner_frames", defaultSpinnerFrames)
+	v.SetDefault("openrouter.spinner_text", "Generating...")
+	v.SetDefault("openrouter.user_label", "You")
+	v.SetDefault("openrouter.assistant_label", "Assistant")
+
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	if err := v.UnmarshalKey("openrouter.model_profiles", &cfg.OpenRouter.ModelProfiles); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal model_profiles: %w", err)
+	}
+	cfg.Offline = offline
+
+	// Validate API keys, api_key goes first in the rotation
+	var keys []string
+	for _, key := range append([]string{cfg.OpenRouter.APIKey}, cfg.OpenRouter.APIKeys...) {
+		key = strings.TrimSpace(key)
+		if key == "" || key == "your-api-key-here" || slices.Contains(keys, key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 && offline {
+		keys = []string{"offline"}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("API key is not configured. Please update config.yaml")
+	}
+	cfg.OpenRouter.APIKey = keys[0]
+	cfg.OpenRouter.APIKeys = keys
+
+	cfg.OpenRouter.BaseURL = strings.TrimRight(strings.TrimSpace(cfg.OpenRouter.BaseURL), "/")
+	if u, err := url.Parse(cfg.OpenRouter.BaseURL); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("base_url must be an http or https URL, got %q", cfg.OpenRouter.BaseURL)
+	}
+
+	cfg.OpenRouter.Referer = strings.TrimSpace(cfg.OpenRouter.Referer)
+	if cfg.OpenRouter.Referer == "" {
+		cfg.OpenRouter.Referer = defaultReferer
+	}
+	cfg.OpenRouter.Title = strings.TrimSpace(cfg.OpenRouter.Title)
+	if cfg.OpenRouter.Title == "" {
+		cfg.OpenRouter.Title = defaultTitle
+	}
+	cfg.OpenRouter.UserLabel = strings.TrimSpace(cfg.OpenRouter.UserLabel)
+	if cfg.OpenRouter.UserLabel == "" {
+		cfg.OpenRouter.UserLabel = "You"
+	}
+	cfg.OpenRouter.AssistantLabel = strings.TrimSpace(cfg.OpenRouter.AssistantLabel)
+	if cfg.OpenRouter.AssistantLabel == "" {
+		cfg.OpenRouter.AssistantLabel = "Assistant"
+	}
+	if len(cfg.OpenRouter.SpinnerFrames) == 0 {
+		log.Printf("spinner_frames is empty, using the default frames")
+		cfg.OpenRouter.SpinnerFrames = defaultSpinnerFrames
+	}
+
+	for _, model := range cfg.OpenRouter.FallbackModels {
+		if !modelSlugPattern.MatchString(model) {
+			return nil, fmt.Errorf("fallback_models: invalid model %q, expected provider/name", model)
+		}
+	}
+
+	if tmpl := cfg.OpenRouter.PromptTemplate; tmpl != "" && !strings.Contains(tmpl, promptPlaceholder) {
+		return nil, fmt.Errorf("prompt_template must contain the %s placeholder, got %q", promptPlaceholder, tmpl)
+	}
+
+	for _, transform := range cfg.OpenRouter.Transforms {
+		if !slices.Contains(supportedTransforms, transform) {
+			return nil, fmt.Errorf("transforms: unknown transform %q, supported: %s",
+				transform, strings.Join(supportedTransforms, ", "))
+		}
+	}
+
+	if seed := cfg.OpenRouter.Seed; seed != nil && *seed < 0 {
+		return nil, fmt.Errorf("seed must not be negative, got %d", *seed)
+	}
+
+	if len(cfg.OpenRouter.Stop) > maxStopSequences {
+		return nil, fmt.Errorf("stop accepts at most %d sequences, got %d", maxStopSequences, len(cfg.OpenRouter.Stop))
+	}
+	for _, stop := range cfg.OpenRouter.Stop {
+		if stop == "" {
+			return nil, fmt.Errorf("stop sequences must not be empty")
+		}
+	}
+
+	for name := range cfg.OpenRouter.Headers {
+		switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+		case "":
+			return nil, fmt.Errorf("headers must not have an empty name")
+		case "Authorization", "Content-Type":
+			return nil, fmt.Errorf("headers must not set %s, it is set by the client", http.CanonicalHeaderKey(name))
+		}
+	}
+
+	switch cfg.OpenRouter.ResponseFormat {
+	case "", "text", "json_object":
+	default:
+		return nil, fmt.Errorf("response_format must be \"text\" or \"json_object\", got %q", cfg.OpenRouter.ResponseFormat)
+	}
+
+	if p := cfg.OpenRouter.Provider; p != nil && p.DataCollection != "" &&
+		p.DataCollection != "allow" && p.DataCollection != "deny" {
+		return nil, fmt.Errorf("provider.data_collection must be \"allow\" or \"deny\", got %q", p.DataCollection)
+	}
+
+	for _, check := range []struct {
+		name  string
+		value int
+	}{
+		{"confirm_above_tokens", cfg.OpenRouter.ConfirmAboveTokens},
+		{"max_context_tokens", cfg.OpenRouter.MaxContextTokens},
+		{"max_display_messages", cfg.OpenRouter.MaxDisplayMessages},
+		{"connect_retries", cfg.OpenRouter.ConnectRetries},
+		{"wrap_width", cfg.OpenRouter.WrapWidth},
+		{"max_markdown_line_length", cfg.OpenRouter.MaxMarkdownLineLength},
+	} {
+		if check.value < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %d", check.name, check.value)
+		}
+	}
+
+	type rangeCheck struct {
+		name     string
+		value    *float64
+		min, max float64
+	}
+	checks := []rangeCheck{
+		{"temperature", cfg.OpenRouter.Temperature, 0, 2},
+		{"top_p", cfg.OpenRouter.TopP, 0, 1},
+		{"frequency_penalty", cfg.OpenRouter.FrequencyPenalty, -2, 2},
+		{"presence_penalty", cfg.OpenRouter.PresencePenalty, -2, 2},
+	}
+	for model, profile := range cfg.OpenRouter.ModelProfiles {
+		if !modelSlugPattern.MatchString(model) {
+			return nil, fmt.Errorf("model_profiles: invalid model %q, expected provider/name", model)
+		}
+		if profile.MaxTokens < 0 {
+			return nil, fmt.Errorf("model_profiles.%s.max_tokens must not be negative, got %d", model, profile.MaxTokens)
+		}
+		if profile.Timeout < 0 {
+			return nil, fmt.Errorf("model_profiles.%s.timeout must not be negative, got %d", model, profile.Timeout)
+		}
+		checks = append(checks,
+			rangeCheck{"model_profiles." + model + ".temperature", profile.Temperature, 0, 2},
+			rangeCheck{"model_profiles." + model + ".top_p", profile.TopP, 0, 1})
+	}
+	for _, check := range checks {
+		if check.value != nil && (*check.value < check.min || *check.value > check.max) {
+			return nil, fmt.Errorf("%s must be between %.1f and %.1f, got %g",
+				check.name, check.min, check.max, *check.value)
+		}
+	}
+
+	for _, binding := range []struct {
+		action string
+		name   string
+		key    *KeyBinding
+	}{
+		{"quit", cfg.Keybindings.Quit, &cfg.Keys.Quit},
+		{"send", cfg.Keybindings.Send, &cfg.Keys.Send},
+		{"clear", cfg.Keybindings.Clear, &cfg.Keys.Clear},
+		{"cancel", cfg.Keybindings.Cancel, &cfg.Keys.Cancel},
+		{"copy", cfg.Keybindings.Copy, &cfg.Keys.Copy},
+		{"focus", cfg.Keybindings.Focus, &cfg.Keys.Focus},
+		{"undo", cfg.Keybindings.Undo, &cfg.Keys.Undo},
+	} {
+		key, err := parseKeyBinding(binding.name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keybindings.%s: %w", binding.action, err)
+		}
+		*binding.key = key
+	}
+	if !cfg.Keys.Send.bound {
+		return nil, fmt.Errorf("keybindings.send must not be empty, messages could not be sent")
+	}
+
+	return &cfg, nil
+}
+
+// defaultHistoryPath returns where the conversation is persisted between runs
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "history.json"
+	}
+	return filepath.Join(home, ".openrouter", "history.json")
+}
+
+// defaultInputHistoryPath returns where submitted inputs are persisted when
+// save_input_history is set
+func defaultInputHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "input_history.json"
+	}
+	return filepath.Join(home, ".openrouter", "input_history.json")
+}
+
+// maskAPIKey shortens an API key to its first and last four characters so it
+// can be logged
+func maskAPIKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+// defaultSessionsDir returns ~/.openrouter/sessions, or a relative directory
+// when the home directory is unknown
+func defaultSessionsDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "sessions"
+	}
+	return filepath.Join(home, ".openrouter", "sessions")
+}
+
+// newHTTPClient returns a client that limits how long to wait for response
+// headers but not the whole request, so long streamed responses aren't cut
+// off. Stalled streams are caught by the idle timeout in handleInput instead.
+func newHTTPClient(timeout int) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Duration(timeout) * time.Second
+	return &http.Client{Transport: transport}
+}
+
+// offlineReply is the canned markdown that -offline answers every message with
+const offlineReply = "## Offline reply\n\n" +
+	"This response was generated locally, so no tokens were spent. It covers the " +
+	"**bold**, *italic* and `inline code` styles, plus a [link](https://openrouter.ai).\n\n" +
+	"- A bullet\n  - A nested bullet\n1. A numbered item\n\n" +
+	"| Feature | Status |\n|---|---|\n| Streaming | simulated |\n| Tables | aligned |\n\n" +
+	"```go\nfmt.Println(\"hello, offline\")\n```\n\n---\n\nDone."
+
+// offlineChunkDelay is the pause between the streamed chunks of an offline reply
+const offlineChunkDelay = 30 * time.Millisecond
+
+// offlineTransport answers API requests locally for -offline mode. Completions
+// echo the last user message followed by offlineReply, streamed a few words
+// at a time when streaming is on.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/models") {
+		body, err := json.Marshal(ModelsResponse{Data: []ModelInfo{
+			{ID: "offline/echo", Name: "Offline echo", ContextLength: 8192},
+		}})
+		if err != nil {
+			return nil, err
+		}
+		return offlineResponse(req, bytes.NewReader(body)), nil
+	}
+
+	var completionReq CompletionRequest
+	if err := json.NewDecoder(req.Body).Decode(&completionReq); err != nil {
+		return nil, fmt.Errorf("failed to decode offline request: %w", err)
+	}
+	reply := offlineReply
+	for i := len(completionReq.Messages) - 1; i >= 0; i-- {
+		if msg := completionReq.Messages[i]; msg.Role == "user" {
+			reply = "You said:\n\n> " + strings.ReplaceAll(msg.Content, "\n", "\n> ") + "\n\n" + reply
+			break
+		}
+	}
+	usage := &Usage{CompletionTokens: estimateTokens(reply)}
+	for _, msg := range completionReq.Messages {
+		usage.PromptTokens += estimateTokens(msg.Content)
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+
+	if !completionReq.Stream {
+		var completion ChatCompletion
+		completion.Model = completionReq.Model
+		completion.Provider = "Offline"
+		completion.Choices = make([]struct {
+			Message struct {
+				Content   string `json:"content"`
+				Reasoning string `json:"reasoning"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		}, 1)
+		completion.Choices[0].Message.Content = reply
+		completion.Choices[0].FinishReason = "stop"
+		completion.Usage = usage
+		body, err := json.Marshal(completion)
+		if err != nil {
+			return nil, err
+		}
+		return offlineResponse(req, bytes.NewReader(body)), nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		write := func(chunk CompletionResponse) bool {
+			data, err := json.Marshal(chunk)
+			if err == nil {
+				_, err = fmt.Fprintf(pw, "data: %s\n\n", data)
+			}
+			return err == nil
+		}
+
+		var chunk CompletionResponse
+		chunk.Model = completionReq.Model
+		chunk.Provider = "Offline"
+		chunk.Choices = make([]struct {
+			Delta struct {
+				Content   string `json:"content"`
+				Reasoning string `json:"reasoning"`
+			} `json:"delta"`
+			FinishReason string `json:"finish_reason"`
+		}, 1)
+		words := strings.SplitAfter(reply, " ")
+		for i, word := range words {
+			select {
+			case <-req.Context().Done():
+				pw.CloseWithError(req.Context().Err())
+				return
+			case <-time.After(offlineChunkDelay):
+			}
+			chunk.Choices[0].Delta.Content = word
+			if i == len(words)-1 {
+				chunk.Choices[0].FinishReason = "stop"
+			}
+			if !write(chunk) {
+				return
+			}
+		}
+
+		chunk.Choices = nil
+		chunk.Usage = usage
+		if write(chunk) {
+			fmt.Fprint(pw, "data: [DONE]\n\n")
+		}
+		pw.Close()
+	}()
+	return offlineResponse(req, pr), nil
+}
+
+// offlineResponse wraps a body in a successful response to req
+func offlineResponse(req *http.Request, body io.Reader) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{},
+		Body:       io.NopCloser(body),
+		Request:    req,
+	}
+}
+
+func NewChatUI(cfg *Config) *ChatUI {
+	ui := &ChatUI{
+		app:            tview.NewApplication(),
+		cfg:            cfg,
+		markdownParser: NewMarkdownParser(),
+		theme:          resolveTheme(cfg),
+		historyPath:    defaultHistoryPath(),
+		inputPath:      defaultInputHistoryPath(),
+		sessionsDir:    defaultSessionsDir(),
+		clients:        make(map[int]*http.Client),
+	}
+	if cfg.Offline {
+		ui.client = &http.Client{Transport: offlineTransport{}}
+	} else {
+		ui.updateClient()
+	}
+	ui.markdownParser.collapseBlankLines = cfg.OpenRouter.CollapseBlankLines
+	ui.markdownParser.raw = !cfg.OpenRouter.RenderMarkdown
+	ui.markdownParser.wrapWidth = cfg.OpenRouter.WrapWidth
+	ui.markdownParser.maxLineLength = cfg.OpenRouter.MaxMarkdownLineLength
+	ui.messages = ui.initialMessages()
+	return ui
+}
+
+// initialMessages returns an empty conversation seeded with the system prompt, if any
+func (ui *ChatUI) initialMessages() []Message {
+	if ui.cfg.OpenRouter.SystemPrompt == "" {
+		return []Message{}
+	}
+	return []Message{{Role: "system", Content: ui.cfg.OpenRouter.SystemPrompt}}
+}
+
+func (ui *ChatUI) SetupUI() {
+	ui.chatHistory = tview.NewTextView().
+		SetDynamicColors(true).
+		SetRegions(true).
+		SetWordWrap(true).
+		SetScrollable(true).
+		SetChangedFunc(func() {
+			ui.app.Draw()
+		})
+	ui.chatHistory.SetBorder(true).SetTitle(" Conversation ")
+	ui.chatHistory.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if ui.searchMatches == 0 {
+			return event
+		}
+		switch {
+		case event.Key() == tcell.KeyEscape:
+			ui.ExitSearch()
+			return nil
+		case event.Key() == tcell.KeyRune && event.Rune() == 'n':
+			ui.jumpToMatch(ui.searchIndex + 1)
+			return nil
+		case event.Key() == tcell.KeyRune && event.Rune() == 'N':
+			ui.jumpToMatch(ui.searchIndex - 1)
+			return nil
+		}
+		return event
+	})
+
+	// Pick up the chat view's width after each draw so a resize re-lays out
+	// rules and tables. Updates cannot be queued from the draw itself.
+	ui.app.SetAfterDrawFunc(func(tcell.Screen) {
+		_, _, width, _ := ui.chatHistory.GetInnerRect()
+		if width != ui.markdownParser.width {
+			go ui.app.QueueUpdateDraw(func() { ui.setViewWidth(width) })
+		}
+	})
+
+	ui.chatHistory.SetHighlightedFunc(func(added, removed, remaining []string) {
+		if slices.Contains(added, "system") {
+			ui.ToggleSystemHeader()
+		}
+	})
+	ui.setChatText(welcomeText)
+
+	ui.loadingSpinner = tview.NewTextView()
+	ui.loadingSpinner.SetTextAlign(tview.AlignCenter)
+
+	ui.inputField = tview.NewInputField().
+		SetLabel(tview.Escape(ui.cfg.OpenRouter.UserLabel) + ": ").
+		SetFieldWidth(0)
+	ui.inputField.SetBorder(true).SetTitle(" Input ").SetTitleAlign(tview.AlignLeft)
+	ui.inputField.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if ui.cfg.Keys.Send.Matches(event) {
+			ui.submitInput()
+			return nil
+		}
+		switch event.Key() {
+		case tcell.KeyUp:
+			ui.recallInput(-1)
+			return nil
+		case tcell.KeyDown:
+			ui.recallInput(1)
+			return nil
+		// Page through the conversation without leaving the input field
+		case tcell.KeyPgUp:
+			ui.scrollChat(-1)
+			return nil
+		case tcell.KeyPgDn:
+			ui.scrollChat(1)
+			return nil
+		}
+		return event
+	})
+
+	ui.statusBar = tview.NewTextView()
+	ui.statusBar.SetTextAlign(tview.AlignRight)
+	// The model is a region so clicking it opens the model picker
+	ui.statusBar.SetRegions(true).SetHighlightedFunc(func(added, removed, remaining []string) {
+		if slices.Contains(added, "model") {
+			ui.statusBar.Highlight()
+			ui.ShowModelPicker()
+		}
+	})
+	ui.statusBar.SetMouseCapture(func(action tview.MouseAction, event *tcell.EventMouse) (tview.MouseAction, *tcell.EventMouse) {
+		// Keep the focus on the input when the status bar is clicked
+		if action == tview.MouseLeftDown {
+			return action, nil
+		}
+		return action, event
+	})
+	ui.SetStatus("Ready")
+
+	ui.flex = tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(ui.chatHistory, 0, 1, false).
+		AddItem(ui.loadingSpinner, 1, 0, false).
+		AddItem(ui.inputField, 3, 1, true).
+		AddItem(ui.statusBar, 1, 1, false)
+	ui.pages = tview.NewPages().AddPage("main", ui.flex, true, true)
+	ui.applyTheme()
+	// The focused pane has the input color on its border. The chat view is
+	// locked while these run, so they can't ask it whether it has the focus.
+	ui.chatHistory.SetFocusFunc(func() { ui.applyBorders(true) })
+	ui.chatHistory.SetBlurFunc(func() { ui.applyBorders(false) })
+
+	keys := ui.cfg.Keys
 	ui.app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if keys.Quit.Matches(event) {
+			ui.Quit()
+			return nil
+		}
+		if keys.Cancel.Matches(event) && ui.CancelRequest() {
+			return nil
+		}
+		if keys.Copy.Matches(event) {
+			ui.CopyLastResponse()
+			return nil
+		}
+		if keys.Clear.Matches(event) {
+			if front, _ := ui.pages.GetFrontPage(); front == "main" && !ui.isLoading() {
+				ui.ClearConversation()
+				return nil
+			}
+		}
+		if keys.Focus.Matches(event) {
+			if front, _ := ui.pages.GetFrontPage(); front == "main" {
+				ui.ToggleFocus()
+				return nil
+			}
+		}
+		// The editor has its own undo
+		if keys.Undo.Matches(event) {
+			if front, _ := ui.pages.GetFrontPage(); front == "main" {
+				ui.UndoLastExchange()
+				return nil
+			}
+		}
+		// tview quits on Ctrl+C by default, which would skip saving the history
 		if event.Key() == tcell.KeyCtrlC {
-			ui.app.Stop()
+			return nil
+		}
+		if event.Key() == tcell.KeyCtrlP {
+			ui.ShowModelPicker()
+			return nil
+		}
+		if event.Key() == tcell.KeyCtrlSpace {
+			if front, _ := ui.pages.GetFrontPage(); front == "main" {
+				ui.ShowCommandPalette()
+				return nil
+			}
+		}
+		if event.Key() == tcell.KeyCtrlW {
+			ui.ToggleWrap()
+			return nil
+		}
+		if event.Key() == tcell.KeyCtrlN {
+			if front, _ := ui.pages.GetFrontPage(); front == "main" {
+				ui.NewMessage()
+				return nil
+			}
+		}
+		if event.Key() == tcell.KeyCtrlE ||
+			(event.Key() == tcell.KeyEnter && event.Modifiers()&tcell.ModAlt != 0) {
+			// Leave the keys to the editor itself once it is open
+			if front, _ := ui.pages.GetFrontPage(); front == "main" {
+				ui.OpenEditor()
+				return nil
+			}
+		}
+		return event
+	})
+}
+
+// submitInput sends the text of the input field or runs it as a command
+func (ui *ChatUI) submitInput() {
+	// The field's input capture runs even while it is disabled, so without
+	// this a second request could start and share the streaming state
+	if ui.isLoading() {
+		return
+	}
+
+	text := ui.inputField.GetText()
+	// Cleared first so commands such as /edit can refill the field
+	ui.inputField.SetText("")
+	if text != "" {
+		ui.addInputHistory(text)
+		ui.handleInput(text)
+	}
+}
+
+// maxInputHistory is how many submitted inputs are kept for recall
+const maxInputHistory = 200
+
+// addInputHistory records a submitted input, skipping a repeat of the last one
+func (ui *ChatUI) addInputHistory(text string) {
+	if n := len(ui.inputHistory); n == 0 || ui.inputHistory[n-1] != text {
+		ui.inputHistory = append(ui.inputHistory, text)
+		if len(ui.inputHistory) > maxInputHistory {
+			ui.inputHistory = ui.inputHistory[len(ui.inputHistory)-maxInputHistory:]
+		}
+	}
+	ui.inputIndex = len(ui.inputHistory)
+	ui.inputDraft = ""
+}
+
+// recallInput moves through the submitted inputs like a shell does, by step
+// entries. Moving past the newest entry restores the text being typed.
+func (ui *ChatUI) recallInput(step int) {
+	index := ui.inputIndex + step
+	if ui.isLoading() || index < 0 || index > len(ui.inputHistory) {
+		return
+	}
+	if ui.inputIndex == len(ui.inputHistory) {
+		ui.inputDraft = ui.inputField.GetText()
+	}
+	ui.inputIndex = index
+	if index == len(ui.inputHistory) {
+		ui.inputField.SetText(ui.inputDraft)
+		return
+	}
+	ui.inputField.SetText(ui.inputHistory[index])
+}
+
+// loadInputHistory reads the input history saved by saveInputHistory
+func (ui *ChatUI) loadInputHistory() error {
+	data, err := os.ReadFile(ui.inputPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read input history: %w", err)
+	}
+	if err := json.Unmarshal(data, &ui.inputHistory); err != nil {
+		return fmt.Errorf("failed to parse input history: %w", err)
+	}
+	ui.inputIndex = len(ui.inputHistory)
+	return nil
+}
+
+// saveInputHistory writes the input history so it survives restarts
+func (ui *ChatUI) saveInputHistory() error {
+	data, err := json.MarshalIndent(ui.inputHistory, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal input history: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(ui.inputPath), 0o700); err != nil {
+		return fmt.Errorf("failed to create input history directory: %w", err)
+	}
+	if err := os.WriteFile(ui.inputPath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write input history: %w", err)
+	}
+	return nil
+}
+
+// ToggleWrap switches line wrapping of the conversation on or off, keeping
+// the scroll position where the line layout allows
+func (ui *ChatUI) ToggleWrap() {
+	ui.noWrap = !ui.noWrap
+	row, _ := ui.chatHistory.GetScrollOffset()
+	ui.chatHistory.SetWrap(!ui.noWrap)
+	ui.chatHistory.ScrollTo(row, 0)
+	if ui.noWrap {
+		ui.SetStatus("Wrap: off")
+	} else {
+		ui.SetStatus("Wrap: on")
+	}
+}
+
+// scrollChat scrolls the conversation by the given number of pages
+func (ui *ChatUI) scrollChat(pages int) {
+	_, _, _, height := ui.chatHistory.GetInnerRect()
+	row, _ := ui.chatHistory.GetScrollOffset()
+	row += pages * max(height-1, 1)
+	if row < 0 {
+		row = 0
+	}
+	ui.chatHistory.ScrollTo(row, 0)
+}
+
+// applyTheme colors the widgets with the current theme
+func (ui *ChatUI) applyTheme() {
+	t := ui.theme
+	ui.flex.SetBackgroundColor(t.Background)
+	ui.chatHistory.SetBackgroundColor(t.Background)
+	ui.chatHistory.SetTextColor(t.Text)
+	ui.loadingSpinner.SetBackgroundColor(t.Background)
+	ui.loadingSpinner.SetTextColor(t.Text)
+	ui.inputField.SetBackgroundColor(t.Background)
+	ui.inputField.SetFieldBackgroundColor(t.Background)
+	ui.inputField.SetFieldTextColor(t.Text)
+	ui.statusBar.SetBackgroundColor(t.Background)
+	ui.statusBar.SetTextColor(t.Status)
+	ui.markdownParser.headingColor = t.Heading
+	ui.applyBorders(ui.chatHistory.HasFocus())
+}
+
+// applyBorders highlights the border of the chat view while it has the
+// focus, and that of the input field otherwise
+func (ui *ChatUI) applyBorders(chatFocused bool) {
+	chat, input := ui.theme.Border, ui.theme.Input
+	if chatFocused {
+		chat, input = ui.theme.Input, ui.theme.Border
+	}
+	ui.chatHistory.SetBorderColor(chat)
+	ui.inputField.SetBorderColor(input)
+}
+
+// ToggleFocus moves the focus between the input field and the chat view,
+// where the conversation can be scrolled with the arrow keys
+func (ui *ChatUI) ToggleFocus() {
+	if !ui.chatHistory.HasFocus() {
+		ui.app.SetFocus(ui.chatHistory)
+		return
+	}
+	if ui.searchMatches > 0 {
+		ui.ExitSearch()
+		return
+	}
+	ui.app.SetFocus(ui.inputField)
+}
+
+// SetTheme switches to a built-in theme and redraws the conversation with it
+func (ui *ChatUI) SetTheme(name string) {
+	theme, ok := themes[name]
+	if !ok {
+		ui.AppendToChat("System", tview.Escape(fmt.Sprintf("Error: unknown theme %q, available: %s",
+			name, strings.Join(themeNames(), ", "))))
+		return
+	}
+
+	ui.theme = theme
+	ui.applyTheme()
+	ui.renderConversation()
+	ui.SetStatus("Theme: " + name)
+}
+
+// SetSeed pins the sampling seed to a non-negative integer, or unsets it for "off"
+func (ui *ChatUI) SetSeed(value string) {
+	if value == "off" {
+		ui.cfg.OpenRouter.Seed = nil
+		ui.AppendToChat("System", "Seed cleared")
+		return
+	}
+	seed, err := strconv.Atoi(value)
+	if err != nil || seed < 0 {
+		ui.AppendToChat("System", tview.Escape(fmt.Sprintf("Error: seed must be a non-negative integer or \"off\", got %q", value)))
+		return
+	}
+	ui.cfg.OpenRouter.Seed = &seed
+	ui.AppendToChat("System", fmt.Sprintf("Seed set to %d", seed))
+}
+
+// ToggleMarkdown switches between rendered and verbatim responses and
+// redraws the conversation in the new mode
+func (ui *ChatUI) ToggleMarkdown() {
+	ui.cfg.OpenRouter.RenderMarkdown = !ui.cfg.OpenRouter.RenderMarkdown
+	ui.markdownParser.raw = !ui.cfg.OpenRouter.RenderMarkdown
+	ui.renderConversation()
+	if ui.markdownParser.raw {
+		ui.AppendToChat("System", "Showing responses verbatim, /raw again to render markdown")
+	} else {
+		ui.AppendToChat("System", "Rendering markdown in responses")
+	}
+}
+
+func (ui *ChatUI) Run() error {
+	ui.SetupUI()
+	if err := ui.LoadHistory(ui.historyPath); err != nil {
+		ui.AppendToChat("System", "Failed to load history: "+tview.Escape(err.Error()))
+	}
+	if system := ui.startupSystem; system != "" && system != ui.systemPrompt() {
+		ui.SetSystemPrompt(system)
+	}
+	if ui.cfg.OpenRouter.SaveInputHistory {
+		if err := ui.loadInputHistory(); err != nil {
+			ui.AppendToChat("System", "Failed to load input history: "+tview.Escape(err.Error()))
+		}
+	}
+	ui.SetStatus("Ready")
+	if prompt := ui.startupPrompt; prompt != "" {
+		// Queued so the request starts once the event loop is running. It
+		// goes the way of typed input, so confirm_above_tokens still applies.
+		go ui.app.QueueUpdateDraw(func() {
+			ui.handleInput(prompt)
+		})
+	}
+	root := &pasteRouter{Pages: ui.pages, ui: ui}
+	return ui.app.SetRoot(root, true).SetFocus(ui.inputField).EnableMouse(true).EnablePaste(true).Run()
+}
+
+func (ui *ChatUI) UpdateStatus(text string) {
+	ui.statusBar.SetText(text)
+}
+
+// SetStatus shows the model, the given state and the estimated conversation size
+func (ui *ChatUI) SetStatus(state string) {
+	tokens := fmt.Sprintf("~%d tokens", ui.conversationTokens())
+	if u := ui.lastUsage; u != nil {
+		tokens = fmt.Sprintf("Tokens: %d prompt + %d completion = %d",
+			u.PromptTokens, u.CompletionTokens, u.TotalTokens)
+	}
+	model := ui.cfg.OpenRouter.Model
+	if ui.lastModel != "" && ui.lastModel != model {
+		model += " → " + ui.lastModel
+	}
+	if ui.lastProvider != "" {
+		model += " via " + ui.lastProvider
+	}
+	if warning := ui.rateLimit.warning(time.Now()); warning != "" {
+		tokens += " | " + warning
+	}
+	ui.UpdateStatus(fmt.Sprintf(`["model"]Model: %s[""] | Status: %s | %s`,
+		tview.Escape(model), tview.Escape(state), tokens))
+}
+
+// setServedBy records where the last response was served, as reported by
+// OpenRouter. Empty values clear it.
+func (ui *ChatUI) setServedBy(provider, model string) {
+	ui.lastProvider = provider
+	ui.lastModel = model
+}
+
+// durationStatus describes how long the last response took, with its speed
+// when the completion token count was reported
+func (ui *ChatUI) durationStatus() string {
+	status := fmt.Sprintf("Done in %.1fs", ui.lastDuration.Seconds())
+	if u := ui.lastUsage; u != nil && u.CompletionTokens > 0 && ui.lastDuration > 0 {
+		status += fmt.Sprintf(" (%.1f tok/s)", float64(u.CompletionTokens)/ui.lastDuration.Seconds())
+	}
+	return status
+}
+
+// estimateTokens approximates the token count of text (roughly 4 characters per token)
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// conversationTokens estimates how many tokens the conversation sends per request
+func (ui *ChatUI) conversationTokens() int {
+	total := 0
+	for _, msg := range ui.templatedMessages(ui.messages) {
+		total += estimateTokens(msg.Content)
+	}
+	return total
+}
+
+// defaultSpinnerFrames animate the loading indicator unless spinner_frames is set
+var defaultSpinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⢰", "⣠", "⣄", "⣆", "⡆", "⠇"}
+
+func (ui *ChatUI) StartLoading() {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	ui.loadingActive = true
+	ui.loadingStart = time.Now()
+	ui.inputField.SetDisabled(true)
+	ui.assistantText = &strings.Builder{}
+
+	go func() {
+		frames := ui.cfg.OpenRouter.SpinnerFrames
+		frameIdx := 0
+
+		for ui.isLoading() {
+			text := spinnerLine(frames[frameIdx], ui.cfg.OpenRouter.SpinnerText)
+			ui.app.QueueUpdateDraw(func() {
+				ui.loadingSpinner.SetText(text)
+			})
+			frameIdx = (frameIdx + 1) % len(frames)
+			time.Sleep(100 * time.Millisecond)
+		}
+		ui.app.QueueUpdateDraw(func() {
+			// Another request may have started in the meantime
+			if !ui.isLoading() {
+				ui.loadingSpinner.SetText("")
+			}
+		})
+	}()
+}
+
+// spinnerLine frames the spinner text with the current frame on both sides,
+// leaving out whichever is empty
+func spinnerLine(frame, text string) string {
+	var parts []string
+	for _, part := range []string{frame, text, frame} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " " + tview.Escape(strings.Join(parts, " ")) + " "
+}
+
+func (ui *ChatUI) StopLoading() {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.loadingActive = false
+	ui.lastDuration = time.Since(ui.loadingStart)
+	ui.cancelRequest = nil
+	ui.continuation = ""
+	ui.inputField.SetDisabled(false)
+	ui.app.SetFocus(ui.inputField)
+}
+
+// shutdownTimeout is how long quitting waits for a cancelled request to wind
+// down before exiting anyway
+const shutdownTimeout = 2 * time.Second
+
+// Quit saves the history and stops the app. A request in flight is cancelled
+// first and its partial response kept; quitting again exits right away.
+func (ui *ChatUI) Quit() {
+	if ui.quitting || !ui.CancelRequest() {
+		ui.stop()
+		return
+	}
+
+	ui.quitting = true
+	ui.SetStatus("Quitting...")
+	go func() {
+		// The request finishes in a queued update, which adds the partial response
+		deadline := time.Now().Add(shutdownTimeout)
+		for ui.isLoading() && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		ui.app.QueueUpdate(ui.stop)
+	}()
+}
+
+// stop saves the history and stops the app, keeping the partial response of
+// a request that didn't wind down in time
+func (ui *ChatUI) stop() {
+	if ui.isLoading() {
+		if partial := ui.assistantText.String(); partial != "" {
+			ui.AddMessage("assistant", partial)
+		}
+	}
+	if err := ui.SaveHistory(ui.historyPath); err != nil {
+		log.Printf("Failed to save history: %v", err)
+	}
+	if ui.cfg.OpenRouter.SaveInputHistory {
+		if err := ui.saveInputHistory(); err != nil {
+			log.Printf("Failed to save input history: %v", err)
+		}
+	}
+	ui.app.Stop()
+}
+
+// isLoading reports whether a request is in flight
+func (ui *ChatUI) isLoading() bool {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	return ui.loadingActive
+}
+
+// CancelRequest aborts the in-flight request and reports whether one was active
+func (ui *ChatUI) CancelRequest() bool {
+	ui.mu.Lock()
+	cancel := ui.cancelRequest
+	ui.cancelRequest = nil
+	ui.mu.Unlock()
+
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// NewMessage cancels the request in flight, if any, and clears the input
+// field for a new message
+func (ui *ChatUI) NewMessage() {
+	cancelled := ui.CancelRequest()
+	ui.inputField.SetText("")
+	ui.inputIndex = len(ui.inputHistory)
+	ui.inputDraft = ""
+	ui.app.SetFocus(ui.inputField)
+	if cancelled {
+		ui.SetStatus("Cancelled, ready for a new message")
+	} else {
+		ui.SetStatus("Ready for a new message")
+	}
+}
+
+func (ui *ChatUI) AddMessage(role, content string) {
+	ui.messages = append(ui.messages, Message{Role: role, Content: content, Time: time.Now()})
+}
+
+// addResponse adds a finished response to the conversation, or appends it to
+// the message it continues
+func (ui *ChatUI) addResponse(content string) {
+	if ui.continuation != "" {
+		ui.messages[len(ui.messages)-1].Content += content
+		return
+	}
+	ui.AddMessage("assistant", content)
+}
+
+// AppendToChat renders and displays a message in the chat view
+func (ui *ChatUI) AppendToChat(role, text string) {
+	ui.appendToChatAt(role, text, time.Now())
+}
+
+// appendToChatAt is AppendToChat for a message sent at the given time; a zero
+// time shows no timestamp
+func (ui *ChatUI) appendToChatAt(role, text string, sent time.Time) {
+	switch role {
+	case "You":
+		ui.startDisplayedMessage()
+		fmt.Fprintf(ui.chatHistory, "%s[%s]%s:[-] %s\n", ui.timestamp(sent), ui.theme.User,
+			tview.Escape(ui.cfg.OpenRouter.UserLabel), tview.Escape(text))
+	case "Assistant":
+		ui.startDisplayedMessage()
+		formatted, ok := "", false
+		if ui.jsonMode() && ui.cfg.OpenRouter.RenderMarkdown {
+			formatted, ok = formatJSON(text)
+		}
+		label := fmt.Sprintf("%s[%s]%s:[-] ", ui.timestamp(sent), ui.theme.Assistant, ui.assistantLabel())
+		if !ok {
+			ui.markdownParser.startColumn = tview.TaggedStringWidth(label)
+			formatted = string(ui.markdownParser.RenderMarkdown(text))
+			ui.widthDependent = ui.widthDependent || ui.markdownParser.widthUsed
+		}
+		fmt.Fprintf(ui.chatHistory, "%s%s\n", label, formatted)
+	case "System":
+		fmt.Fprintf(ui.chatHistory, "%s[%s]System:[-] %s\n", ui.timestamp(sent), ui.theme.System, text)
+	default:
+		fmt.Fprintf(ui.chatHistory, "%s%s: %s\n", ui.timestamp(sent), role, text)
+	}
+	ui.chatHistory.ScrollToEnd()
+}
+
+// StartAssistantMessage writes the label for a streamed response. A
+// continuation redraws the message it continues instead, to stream onto it.
+func (ui *ChatUI) StartAssistantMessage() {
+	sent := time.Now()
+	if ui.continuation != "" {
+		sent = ui.messages[len(ui.messages)-1].Time
+		ui.dropLastDisplayed()
+	}
+	label := fmt.Sprintf("%s[%s]%s:[-] ", ui.timestamp(sent), ui.theme.Assistant, ui.assistantLabel())
+	ui.markdownParser.startColumn = tview.TaggedStringWidth(label)
+	ui.markdownParser.Reset()
+	ui.reasoningOpen = false
+	ui.reasoningTail = ""
+	ui.answerStart = -1
+	ui.startDisplayedMessage()
+	fmt.Fprint(ui.chatHistory, label)
+	if ui.continuation != "" {
+		ui.AppendPartialAssistant(ui.continuation)
+	}
+}
+
+// dropLastDisplayed removes the last message shown in the chat view, along
+// with the notes after it
+func (ui *ChatUI) dropLastDisplayed() {
+	ui.ExitSearch()
+	if n := len(ui.messageOffsets); n > 0 {
+		text := ui.chatHistory.GetText(false)
+		ui.chatHistory.SetText(text[:ui.messageOffsets[n-1]])
+		ui.messageOffsets = ui.messageOffsets[:n-1]
+	}
+}
+
+// timestamp returns the dimmed time shown before a message when
+// show_timestamps is set, or "" for a zero time
+func (ui *ChatUI) timestamp(sent time.Time) string {
+	if !ui.cfg.OpenRouter.ShowTimestamps || sent.IsZero() {
+		return ""
+	}
+	return "[gray::d]" + tview.Escape(sent.Format("[15:04:05]")) + "[-::-] "
+}
+
+// hiddenMarker tops the chat view once older messages are dropped from it
+var hiddenMarker = "[gray]" + tview.Escape("[older messages hidden]") + "[-]\n"
+
+// startDisplayedMessage records where the next message starts in the chat
+// view and drops the oldest messages from the view past max_display_messages
+func (ui *ChatUI) startDisplayedMessage() {
+	text := ui.chatHistory.GetText(false)
+	ui.messageOffsets = append(ui.messageOffsets, len(text))
+
+	limit := ui.cfg.OpenRouter.MaxDisplayMessages
+	// Search results are tagged into the text, so trimming waits until the search ends
+	if limit <= 0 || len(ui.messageOffsets) <= limit || ui.searchMatches > 0 {
+		return
+	}
+	drop := len(ui.messageOffsets) - limit
+	cut := ui.messageOffsets[drop]
+	prefix := text[:ui.headerLen] + hiddenMarker
+	ui.chatHistory.SetText(prefix + text[cut:])
+	ui.messageOffsets = ui.messageOffsets[drop:]
+	for i := range ui.messageOffsets {
+		ui.messageOffsets[i] += len(prefix) - cut
+	}
+}
+
+// setChatText replaces the chat view text with body under the system prompt header
+func (ui *ChatUI) setChatText(body string) {
+	header := ui.systemHeader()
+	ui.headerLen = len(header)
+	ui.chatHistory.SetText(header + body)
+}
+
+// systemPrompt returns the system prompt sent with the conversation, if any
+func (ui *ChatUI) systemPrompt() string {
+	if len(ui.messages) > 0 && ui.messages[0].Role == "system" {
+		return ui.messages[0].Content
+	}
+	return ""
+}
+
+// systemHeader returns the dimmed line topping the chat view while a system
+// prompt is sent. It shows the whole prompt once expanded, and is a region
+// so clicking it expands or collapses it.
+func (ui *ChatUI) systemHeader() string {
+	prompt := ui.systemPrompt()
+	if prompt == "" {
+		return ""
+	}
+	if !ui.systemExpanded {
+		return `["system"][gray::d]▸ ` + tview.Escape("[system prompt active]") + `[-::-][""]` + "\n"
+	}
+	return `["system"][gray::d]▾ System prompt:[-::-][""]` + "\n[gray::d]" + tview.Escape(prompt) + "[-::-]\n"
+}
+
+// refreshSystemHeader redraws the system prompt header in place, keeping the
+// rest of the chat view
+func (ui *ChatUI) refreshSystemHeader() {
+	ui.ExitSearch()
+	header := ui.systemHeader()
+	text := ui.chatHistory.GetText(false)
+	ui.chatHistory.SetText(header + text[ui.headerLen:])
+
+	delta := len(header) - ui.headerLen
+	for i := range ui.messageOffsets {
+		ui.messageOffsets[i] += delta
+	}
+	if ui.answerStart >= 0 {
+		ui.answerStart += delta
+	}
+	ui.headerLen = len(header)
+}
+
+// ToggleSystemHeader expands or collapses the system prompt header
+func (ui *ChatUI) ToggleSystemHeader() {
+	ui.chatHistory.Highlight()
+	if ui.systemPrompt() == "" {
+		ui.AppendToChat("System", "No system prompt set")
+		return
+	}
+	ui.systemExpanded = !ui.systemExpanded
+	ui.refreshSystemHeader()
+	if ui.systemExpanded {
+		ui.chatHistory.ScrollToBeginning()
+	}
+}
+
+// assistantLabel returns the escaped name shown before assistant messages
+func (ui *ChatUI) assistantLabel() string {
+	label := strings.ReplaceAll(ui.cfg.OpenRouter.AssistantLabel, "{model}", ui.cfg.OpenRouter.Model)
+	return tview.Escape(label)
+}
+
+// AppendReasoning appends a streamed piece of the reasoning trace, dimmed and
+// without markdown so it reads apart from the answer. The trace isn't stored
+// with the message, so it is gone once the conversation is redrawn.
+func (ui *ChatUI) AppendReasoning(text string) {
+	if !ui.reasoningOpen {
+		fmt.Fprint(ui.chatHistory, "[gray]Reasoning:[-]\n")
+		ui.reasoningOpen = true
+	}
+
+	// Hold back an unclosed "[" so a tag split across deltas is still escaped
+	text = ui.reasoningTail + text
+	cut := len(text)
+	if i := strings.LastIndexByte(text, '['); i >= 0 && strings.IndexByte(text[i:], ']') < 0 {
+		cut = i
+	}
+	ui.writeReasoning(text[:cut])
+	ui.reasoningTail = text[cut:]
+	ui.chatHistory.ScrollToEnd()
+}
+
+// writeReasoning writes reasoning text in the dimmed style
+func (ui *ChatUI) writeReasoning(text string) {
+	if text == "" {
+		return
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = tview.Escape(filteredString(line))
+	}
+	fmt.Fprintf(ui.chatHistory, "[gray::d]%s[-::-]", strings.Join(lines, "\n"))
+}
+
+// closeReasoning ends the reasoning trace so the answer starts on its own line
+func (ui *ChatUI) closeReasoning() {
+	if !ui.reasoningOpen {
+		return
+	}
+	ui.writeReasoning(ui.reasoningTail)
+	fmt.Fprint(ui.chatHistory, "\n")
+	// The answer starts on the line after the trace
+	ui.markdownParser.column = 0
+	ui.reasoningOpen = false
+	ui.reasoningTail = ""
+}
+
+// AppendPartialAssistant appends a streamed delta with markdown applied.
+// Only the newly rendered text is written; earlier output is never redrawn.
+func (ui *ChatUI) AppendPartialAssistant(text string) {
+	ui.closeReasoning()
+	if ui.answerStart < 0 {
+		ui.answerStart = len(ui.chatHistory.GetText(false))
+	}
+	ui.chatHistory.Write(ui.markdownParser.RenderPartial(text))
+	ui.chatHistory.ScrollToEnd()
+}
+
+// FinishAssistantMessage writes out anything the renderer held back and ends
+// the streamed response the same way AppendToChat ends a message
+func (ui *ChatUI) FinishAssistantMessage() {
+	ui.closeReasoning()
+	ui.chatHistory.Write(ui.markdownParser.Flush())
+	ui.widthDependent = ui.widthDependent || ui.markdownParser.widthUsed
+	fmt.Fprint(ui.chatHistory, "\n")
+	ui.chatHistory.ScrollToEnd()
+}
+
+// jsonMode reports whether responses are requested and shown as JSON
+func (ui *ChatUI) jsonMode() bool {
+	return ui.cfg.OpenRouter.ResponseFormat == "json_object"
+}
+
+// showJSONResponse redraws the finished response pretty-printed as JSON in
+// JSON mode. It streams in as markdown since partial JSON can't be indented,
+// and is left that way when it doesn't parse.
+func (ui *ChatUI) showJSONResponse(content string) {
+	if !ui.jsonMode() || !ui.cfg.OpenRouter.RenderMarkdown || ui.answerStart < 0 || ui.searchMatches > 0 {
+		return
+	}
+	formatted, ok := formatJSON(content)
+	if !ok {
+		return
+	}
+	text := ui.chatHistory.GetText(false)
+	ui.chatHistory.SetText(text[:ui.answerStart] + formatted + "\n")
+	ui.answerStart = -1
+	ui.chatHistory.ScrollToEnd()
+}
+
+// SetJSONMode turns requesting JSON responses on or off
+func (ui *ChatUI) SetJSONMode(on bool) {
+	if on {
+		ui.cfg.OpenRouter.ResponseFormat = "json_object"
+		ui.AppendToChat("System", "JSON mode on, responses are requested and shown as JSON")
+	} else {
+		ui.cfg.OpenRouter.ResponseFormat = ""
+		ui.AppendToChat("System", "JSON mode off")
+	}
+}
+
+// lastAssistantMessage returns the raw content of the most recent assistant reply
+func (ui *ChatUI) lastAssistantMessage() (string, bool) {
+	for i := len(ui.messages) - 1; i >= 0; i-- {
+		if ui.messages[i].Role == "assistant" {
+			return ui.messages[i].Content, true
+		}
+	}
+	return "", false
+}
+
+// CopyLastResponse copies the last assistant reply as raw markdown to the clipboard
+func (ui *ChatUI) CopyLastResponse() {
+	text, ok := ui.lastAssistantMessage()
+	if !ok {
+		return
+	}
+
+	if err := clipboard.WriteAll(text); err != nil {
+		ui.AppendToChat("System", "Error: failed to copy to clipboard: "+tview.Escape(err.Error()))
+		return
+	}
+	ui.SetStatus("Copied to clipboard")
+}
+
+// SaveHistory writes the conversation to path as JSON
+func (ui *ChatUI) SaveHistory(path string) error {
+	stored := make([]storedMessage, len(ui.messages))
+	for i, msg := range ui.messages {
+		stored[i] = storedMessage(msg)
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal history: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+
+	// Write to a temporary file and rename it over the history so a crash
+	// mid-write can't leave a corrupt file behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return nil
+}
+
+// autosave saves the history after an exchange when autosave is enabled
+func (ui *ChatUI) autosave() {
+	if !ui.cfg.OpenRouter.Autosave {
+		return
+	}
+	if err := ui.SaveHistory(ui.historyPath); err != nil {
+		ui.AppendToChat("System", "Error: failed to autosave history: "+tview.Escape(err.Error()))
+	}
+}
+
+// LoadHistory restores a conversation saved by SaveHistory and renders it.
+// A missing file is not an error.
+func (ui *ChatUI) LoadHistory(path string) error {
+	messages, err := readMessages(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	ui.messages = messages
+	ui.renderConversation()
+	return nil
+}
+
+// readMessages reads a conversation written by SaveHistory
+func readMessages(path string) ([]Message, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	var messages []Message
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("failed to parse history: %w", err)
+	}
+	return messages, nil
+}
+
+// sessionNamePattern limits session names to safe file names
+var sessionNamePattern = regexp.MustCompile(`^[\w-][\w.-]*$`)
+
+// sessionPath returns the file a named session is stored in
+func (ui *ChatUI) sessionPath(name string) (string, error) {
+	if !sessionNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid session name %q, use letters, digits, '.', '-' and '_'", name)
+	}
+	return filepath.Join(ui.sessionsDir, name+".json"), nil
+}
+
+// SaveSession stores the conversation under a name for /load
+func (ui *ChatUI) SaveSession(name string) {
+	path, err := ui.sessionPath(name)
+	if err != nil {
+		ui.AppendToChat("System", "Error: "+tview.Escape(err.Error()))
+		return
+	}
+	if err := ui.SaveHistory(path); err != nil {
+		ui.AppendToChat("System", "Error: failed to save session: "+tview.Escape(err.Error()))
+		return
+	}
+	ui.AppendToChat("System", tview.Escape(fmt.Sprintf("Session saved as %q", name)))
+}
+
+// LoadSession replaces the conversation with a named session
+func (ui *ChatUI) LoadSession(name string) {
+	if ui.isLoading() {
+		ui.AppendToChat("System", "Error: wait for the current response before loading a session")
+		return
+	}
+
+	path, err := ui.sessionPath(name)
+	if err != nil {
+		ui.AppendToChat("System", "Error: "+tview.Escape(err.Error()))
+		return
+	}
+	messages, err := readMessages(path)
+	if errors.Is(err, os.ErrNotExist) {
+		ui.AppendToChat("System", tview.Escape(fmt.Sprintf("Error: no session named %q, see /sessions", name)))
+		return
+	} else if err != nil {
+		ui.AppendToChat("System", "Error: failed to load session: "+tview.Escape(err.Error()))
+		return
+	}
+
+	ui.messages = messages
+	ui.lastUsage = nil
+	ui.setServedBy("", "")
+	ui.renderConversation()
+	ui.SetStatus(fmt.Sprintf("Loaded session %q", name))
+}
+
+// ListSessions shows the names of the saved sessions
+func (ui *ChatUI) ListSessions() {
+	files, err := filepath.Glob(filepath.Join(ui.sessionsDir, "*.json"))
+	if err != nil {
+		ui.AppendToChat("System", "Error: failed to list sessions: "+tview.Escape(err.Error()))
+		return
+	}
+	if len(files) == 0 {
+		ui.AppendToChat("System", "No saved sessions, use /save <name> to create one")
+		return
+	}
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = strings.TrimSuffix(filepath.Base(file), ".json")
+	}
+	ui.AppendToChat("System", "Sessions: "+strings.Join(names, ", "))
+}
+
+// renderConversation redraws the chat view from the stored messages
+func (ui *ChatUI) renderConversation() {
+	ui.widthDependent = false
+	ui.messageOffsets = nil
+	ui.setChatText(welcomeText)
+
+	// Skip the messages max_display_messages would drop right away
+	messages := ui.messages
+	if limit := ui.cfg.OpenRouter.MaxDisplayMessages; limit > 0 {
+		shown := 0
+		for i := len(messages) - 1; i >= 0; i-- {
+			if messages[i].Role != "user" && messages[i].Role != "assistant" {
+				continue
+			}
+			if shown++; shown > limit {
+				ui.setChatText(hiddenMarker)
+				messages = messages[i+1:]
+				break
+			}
+		}
+	}
+	for _, msg := range messages {
+		ui.renderMessage(msg)
+	}
+	ui.chatHistory.ScrollToEnd()
+}
+
+// setViewWidth sets the width the renderer lays output out to and redraws
+// the conversation if it holds content laid out to the previous width
+func (ui *ChatUI) setViewWidth(width int) {
+	if width == ui.markdownParser.width {
+		return
+	}
+	ui.markdownParser.width = width
+	if ui.widthDependent && !ui.isLoading() && ui.searchMatches == 0 {
+		ui.renderConversation()
+	}
+}
+
+// renderMessage displays a stored message using its chat label
+func (ui *ChatUI) renderMessage(msg Message) {
+	switch msg.Role {
+	case "user":
+		ui.appendToChatAt("You", msg.Content, msg.Time)
+	case "assistant":
+		ui.appendToChatAt("Assistant", msg.Content, msg.Time)
+	}
+}
+
+// ClearConversation drops all messages and resets the chat view to the welcome banner
+func (ui *ChatUI) ClearConversation() {
+	ui.messages = ui.initialMessages()
+	ui.pendingImages = nil
+	ui.lastUsage = nil
+	ui.setServedBy("", "")
+	ui.markdownParser.Reset()
+	ui.widthDependent = false
+	ui.messageOffsets = nil
+	ui.setChatText(welcomeText)
+	ui.SetStatus("Conversation cleared")
+	ui.app.SetFocus(ui.inputField)
+}
+
+// SetModel switches the model used for subsequent requests (in memory only)
+func (ui *ChatUI) SetModel(model string) {
+	if !modelSlugPattern.MatchString(model) {
+		ui.AppendToChat("System", tview.Escape(fmt.Sprintf("Error: invalid model %q, expected provider/name", model)))
+		return
+	}
+	if ui.isLoading() {
+		ui.AppendToChat("System", "Error: wait for the current response before switching models")
+		return
+	}
+
+	ui.cfg.OpenRouter.Model = model
+	ui.updateClient()
+	ui.setServedBy("", "")
+	ui.SetStatus("Ready")
+	ui.AppendToChat("System", "Switched model to "+model)
+	if _, ok := ui.cfg.OpenRouter.ModelProfiles[model]; ok {
+		ui.AppendToChat("System", "Using its profile: "+ui.modelProfile(model).String())
+	}
+}
+
+// modelProfile returns the sampling parameters for model, taking those its
+// profile leaves unset from the top-level config. -max-tokens wins over both.
+func (ui *ChatUI) modelProfile(model string) ModelProfile {
+	profile := ui.cfg.OpenRouter.ModelProfiles[model]
+	if profile.Temperature == nil {
+		profile.Temperature = ui.cfg.OpenRouter.Temperature
+	}
+	if profile.TopP == nil {
+		profile.TopP = ui.cfg.OpenRouter.TopP
+	}
+	if profile.MaxTokens == 0 {
+		profile.MaxTokens = ui.cfg.OpenRouter.MaxTokens
+	}
+	if ui.cfg.MaxTokensOverride > 0 {
+		profile.MaxTokens = ui.cfg.MaxTokensOverride
+	}
+	if profile.Timeout == 0 {
+		profile.Timeout = ui.cfg.OpenRouter.Timeout
+	}
+	return profile
+}
+
+// updateClient switches to the HTTP client for the current model's timeout
+func (ui *ChatUI) updateClient() {
+	ui.client = ui.clientFor(ui.cfg.OpenRouter.Model)
+}
+
+// clientFor returns the HTTP client with model's timeout. Models with the
+// same timeout share a client, and so its connections.
+func (ui *ChatUI) clientFor(model string) *http.Client {
+	if ui.cfg.Offline {
+		return ui.client
+	}
+	timeout := ui.modelProfile(model).Timeout
+	client, ok := ui.clients[timeout]
+	if !ok {
+		client = newHTTPClient(timeout)
+		ui.clients[timeout] = client
+	}
+	return client
+}
+
+// String lists the parameters that are set, e.g. "temperature 0.2, max_tokens 1024"
+func (p ModelProfile) String() string {
+	var parts []string
+	if p.Temperature != nil {
+		parts = append(parts, fmt.Sprintf("temperature %g", *p.Temperature))
+	}
+	if p.TopP != nil {
+		parts = append(parts, fmt.Sprintf("top_p %g", *p.TopP))
+	}
+	if p.MaxTokens > 0 {
+		parts = append(parts, fmt.Sprintf("max_tokens %d", p.MaxTokens))
+	}
+	if p.Timeout > 0 {
+		parts = append(parts, fmt.Sprintf("timeout %ds", p.Timeout))
+	}
+	if len(parts) == 0 {
+		return "model defaults"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// apiURL returns the URL of an API endpoint under the configured base URL
+func (ui *ChatUI) apiURL(path string) string {
+	return ui.cfg.OpenRouter.BaseURL + path
+}
+
+// fetchModels downloads the list of models available on OpenRouter
+func (ui *ChatUI) fetchModels() ([]ModelInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(ui.cfg.OpenRouter.Timeout)*time.Second)
+	defer cancel()
+
+	resp, err := ui.doWithRetry(ctx, ui.client, func(apiKey string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", ui.apiURL("/models"), nil)
+		if err != nil {
+			return nil, err
+		}
+		ui.setHeaders(req, apiKey)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API error (%d): %s", resp.StatusCode, apiErrorMessage(body))
+	}
+
+	var models ModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+		return nil, fmt.Errorf("failed to parse models: %w", err)
+	}
+	return models.Data, nil
+}
+
+// withModels calls fn on the UI goroutine with the models list, fetching it
+// in the background the first time and reusing it for the rest of the session
+func (ui *ChatUI) withModels(fn func([]ModelInfo)) {
+	if ui.models != nil {
+		fn(ui.models)
+		return
+	}
+
+	ui.SetStatus("Loading models...")
+	go func() {
+		models, err := ui.fetchModels()
+		ui.app.QueueUpdateDraw(func() {
+			ui.SetStatus("Ready")
+			if err != nil {
+				ui.AppendToChat("System", "Error: failed to load models: "+tview.Escape(err.Error()))
+				return
+			}
+			ui.models = models
+			fn(models)
+		})
+	}()
+}
+
+// describeModel summarizes context length and pricing (USD per million tokens)
+func describeModel(m ModelInfo) string {
+	prompt, _ := strconv.ParseFloat(m.Pricing.Prompt, 64)
+	completion, _ := strconv.ParseFloat(m.Pricing.Completion, 64)
+	return fmt.Sprintf("%d context | $%.2f in / $%.2f out per 1M tokens",
+		m.ContextLength, prompt*1e6, completion*1e6)
+}
+
+// maxListedModels caps how many models /models prints
+const maxListedModels = 50
+
+// ListModels prints the models whose id contains filter, ignoring case, with
+// their context length
+func (ui *ChatUI) ListModels(filter string) {
+	ui.withModels(func(models []ModelInfo) {
+		filter = strings.ToLower(filter)
+		var matches []ModelInfo
+		for _, m := range models {
+			if strings.Contains(strings.ToLower(m.ID), filter) {
+				matches = append(matches, m)
+			}
+		}
+		if len(matches) == 0 {
+			ui.AppendToChat("System", tview.Escape(fmt.Sprintf("No models match %q", filter)))
+			return
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "%d model(s):", len(matches))
+		for _, m := range matches[:min(len(matches), maxListedModels)] {
+			fmt.Fprintf(&b, "\n  %s — %d context", tview.Escape(m.ID), m.ContextLength)
+		}
+		if len(matches) > maxListedModels {
+			fmt.Fprintf(&b, "\n  ...and %d more, narrow the filter to see them", len(matches)-maxListedModels)
+		}
+		ui.AppendToChat("System", b.String())
+	})
+}
+
+// centered wraps p in a layout that keeps it centered at the given size
+// applyPopupTheme colors a filterable list popup with the current theme
+func (ui *ChatUI) applyPopupTheme(box *tview.Flex, filter *tview.InputField, list *tview.List) {
+	t := ui.theme
+	box.SetBackgroundColor(t.Background)
+	box.SetBorderColor(t.Border)
+	box.SetTitleColor(t.Text)
+	filter.SetBackgroundColor(t.Background)
+	filter.SetLabelColor(t.Status)
+	filter.SetFieldBackgroundColor(t.Background)
+	filter.SetFieldTextColor(t.Text)
+	list.SetBackgroundColor(t.Background)
+	list.SetMainTextColor(t.Text)
+	list.SetSecondaryTextColor(t.Status)
+	list.SetSelectedBackgroundColor(t.Text)
+	list.SetSelectedTextColor(t.Background)
+}
+
+func centered(p tview.Primitive, width, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(p, height, 1, true).
+			AddItem(nil, 0, 1, false), width, 1, true).
+		AddItem(nil, 0, 1, false)
+}
+
+// ShowModelPicker opens a filterable list of models; selecting one switches to it
+func (ui *ChatUI) ShowModelPicker() {
+	if ui.pages.HasPage("models") {
+		return
+	}
+	if ui.isLoading() {
+		ui.AppendToChat("System", "Error: wait for the current response before switching models")
+		return
+	}
+	ui.withModels(ui.openModelPicker)
+}
+
+func (ui *ChatUI) openModelPicker(models []ModelInfo) {
+	list := tview.NewList()
+	filter := tview.NewInputField().SetLabel("Filter: ")
+
+	closePicker := func() {
+		ui.pages.RemovePage("models")
+		ui.app.SetFocus(ui.inputField)
+	}
+	populate := func(query string) {
+		list.Clear()
+		query = strings.ToLower(query)
+		for _, m := range models {
+			if !strings.Contains(strings.ToLower(m.ID), query) {
+				continue
+			}
+			id := m.ID
+			list.AddItem(id, describeModel(m), 0, func() {
+				closePicker()
+				ui.SetModel(id)
+			})
+		}
+	}
+	populate("")
+
+	filter.SetChangedFunc(populate)
+	filter.SetDoneFunc(func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEscape:
+			closePicker()
+		case tcell.KeyEnter:
+			if list.GetItemCount() > 0 {
+				ui.app.SetFocus(list)
+			}
+		}
+	})
+	filter.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyDown || event.Key() == tcell.KeyTab {
+			ui.app.SetFocus(list)
 			return nil
 		}
 		return event
 	})
+	list.SetDoneFunc(closePicker)
+
+	box := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(filter, 1, 0, true).
+		AddItem(list, 0, 1, false)
+	box.SetBorder(true).SetTitle(" Select model (Esc to close) ")
+	ui.applyPopupTheme(box, filter, list)
+
+	ui.pages.AddPage("models", centered(box, 80, 24), true, true)
+	ui.app.SetFocus(filter)
 }
 
-func (ui *ChatUI) Run() error {
-	ui.SetupUI()
-	return ui.app.SetRoot(ui.flex, true).SetFocus(ui.inputField).EnableMouse(true).Run()
+// pasteRouter is the root of the UI. A multi-line paste into the single-line
+// input field opens the editor with it instead, so the newlines are kept
+// rather than submitting or being lost; other pastes go to the focused widget.
+type pasteRouter struct {
+	*tview.Pages
+	ui *ChatUI
 }
 
-func (ui *ChatUI) UpdateStatus(text string) {
-	ui.statusBar.SetText(text)
+func (r *pasteRouter) PasteHandler() func(text string, setFocus func(p tview.Primitive)) {
+	handler := r.Pages.PasteHandler()
+	return func(text string, setFocus func(p tview.Primitive)) {
+		if strings.ContainsRune(text, '\n') && r.ui.inputField.HasFocus() {
+			r.ui.openEditor(r.ui.inputField.GetText() + text)
+			return
+		}
+		handler(text, setFocus)
+	}
 }
 
-func (ui *ChatUI) StartLoading() {
-	ui.mu.Lock()
-	defer ui.mu.Unlock()
+// OpenEditor opens a multi-line editor prefilled with the input field text.
+// Its content is sent with newlines intact.
+func (ui *ChatUI) OpenEditor() {
+	ui.openEditor(ui.inputField.GetText())
+}
 
-	ui.loadingActive = true
-	ui.inputField.SetDisabled(true)
-	ui.assistantText = &strings.Builder{}
+// openEditor opens the multi-line editor prefilled with text
+func (ui *ChatUI) openEditor(text string) {
+	if ui.isLoading() {
+		ui.AppendToChat("System", "Error: wait for the current response before composing a multi-line message")
+		return
+	}
 
-	go func() {
-		frames := []string{"⠋", "⠙", "⠹", "⠸", "⢰", "⣠", "⣄", "⣆", "⡆", "⠇"}
-		frameIdx := 0
+	editor := tview.NewTextArea().SetText(text, true)
+	editor.SetBorder(true).
+		SetTitle(" Compose (Ctrl+S or Alt+Enter to send, Esc to cancel) ").
+		SetBorderColor(tcell.ColorGreen)
 
-		for ui.loadingActive {
-			text := fmt.Sprintf(" %s Generating... %s ", frames[frameIdx], frames[frameIdx])
-			ui.app.QueueUpdateDraw(func() {
-				ui.loadingSpinner.SetText(text)
+	closeEditor := func() {
+		ui.pages.RemovePage("editor")
+		ui.app.SetFocus(ui.inputField)
+	}
+	editor.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case event.Key() == tcell.KeyEscape:
+			closeEditor()
+			return nil
+		case event.Key() == tcell.KeyCtrlS,
+			event.Key() == tcell.KeyEnter && event.Modifiers()&tcell.ModAlt != 0:
+			text := editor.GetText()
+			closeEditor()
+			if strings.TrimSpace(text) != "" {
+				ui.inputField.SetText("")
+				ui.addInputHistory(text)
+				ui.handleInput(text)
+			}
+			return nil
+		}
+		return event
+	})
+
+	ui.pages.AddPage("editor", centered(editor, 100, 20), true, true)
+	ui.app.SetFocus(editor)
+}
+
+// SetSystemPrompt replaces the system prompt sent with the conversation
+func (ui *ChatUI) SetSystemPrompt(prompt string) {
+	ui.cfg.OpenRouter.SystemPrompt = prompt
+
+	if len(ui.messages) > 0 && ui.messages[0].Role == "system" {
+		ui.messages[0].Content = prompt
+	} else {
+		ui.messages = append([]Message{{Role: "system", Content: prompt}}, ui.messages...)
+	}
+	ui.refreshSystemHeader()
+	ui.AppendToChat("System", "System prompt updated")
+	ui.SetStatus("Ready")
+}
+
+// markSearchMatches wraps every case-insensitive match of query in the
+// visible text of a tagged chat text with numbered region tags. It returns the
+// marked text and the number of matches.
+func markSearchMatches(text, query string) (string, int) {
+	// Collect the visible bytes and remember where each one is in text
+	visible := &strings.Builder{}
+	var offsets []int
+	tagRun := -1 // Tag characters since the last visible "[", as in writeText
+	tagBrackets := false
+	for i := 0; i < len(text); {
+		if text[i] == '[' {
+			if tag := tviewTagPattern.FindString(text[i:]); tag != "" {
+				i += len(tag)
+				tagRun = -1
+				tagBrackets = false
+				continue
+			}
+			// Skip the "[" that escapes the "]" of a literal "[red]" or "[red[]"
+			if (tagRun > 0 || tagBrackets) && strings.HasPrefix(text[i:], "[]") {
+				i++
+				continue
+			}
+		}
+		switch c := text[i]; {
+		case c == '[':
+			tagBrackets = tagBrackets || tagRun > 0
+			tagRun = 0
+		case tagRun >= 0 && isTagChar(c):
+			tagRun++
+			tagBrackets = false
+		default:
+			tagRun = -1
+			tagBrackets = false
+		}
+		visible.WriteByte(text[i])
+		offsets = append(offsets, i)
+		i++
+	}
+
+	re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(query))
+	matches := re.FindAllStringIndex(visible.String(), -1)
+
+	marked := &strings.Builder{}
+	last := 0
+	for n, m := range matches {
+		start, end := offsets[m[0]], offsets[m[1]-1]+1
+		marked.WriteString(text[last:start])
+		fmt.Fprintf(marked, `["search-%d"]%s[""]`, n, text[start:end])
+		last = end
+	}
+	marked.WriteString(text[last:])
+	return marked.String(), len(matches)
+}
+
+// StartSearch highlights matches of query in the conversation and moves focus
+// to the chat view, where n/N jump between matches and Escape exits
+func (ui *ChatUI) StartSearch(query string) {
+	text := ui.chatHistory.GetText(false)
+	marked, count := markSearchMatches(text, query)
+	if count == 0 {
+		ui.SetStatus(fmt.Sprintf("No matches for %q", query))
+		return
+	}
+
+	ui.searchText = text
+	ui.searchMatches = count
+	ui.chatHistory.SetText(marked)
+	ui.app.SetFocus(ui.chatHistory)
+	// Start from the most recent match, closest to where the view is
+	ui.jumpToMatch(count - 1)
+}
+
+// jumpToMatch highlights the i-th search match, wrapping around at both ends
+func (ui *ChatUI) jumpToMatch(i int) {
+	ui.searchIndex = (i + ui.searchMatches) % ui.searchMatches
+	ui.chatHistory.Highlight(fmt.Sprintf("search-%d", ui.searchIndex)).ScrollToHighlight()
+	ui.SetStatus(fmt.Sprintf("Match %d/%d (n/N to jump, Esc to exit)", ui.searchIndex+1, ui.searchMatches))
+}
+
+// ExitSearch removes search highlights and returns focus to the input field
+func (ui *ChatUI) ExitSearch() {
+	if ui.searchMatches == 0 {
+		return
+	}
+
+	ui.chatHistory.Highlight()
+	ui.chatHistory.SetText(ui.searchText)
+	ui.chatHistory.ScrollToEnd()
+	ui.searchText = ""
+	ui.searchMatches = 0
+	ui.app.SetFocus(ui.inputField)
+	ui.SetStatus("Ready")
+}
+
+// formatTranscript renders messages as a Markdown document using the raw
+// message content
+func formatTranscript(messages []Message) string {
+	out := &strings.Builder{}
+	for _, msg := range messages {
+		switch msg.Role {
+		case "user":
+			out.WriteString("**You:**\n\n")
+		case "assistant":
+			out.WriteString("**Assistant:**\n\n")
+		case "system":
+			out.WriteString("**System:**\n\n")
+		default:
+			fmt.Fprintf(out, "**%s:**\n\n", msg.Role)
+		}
+		out.WriteString(strings.TrimSpace(msg.Content))
+		out.WriteString("\n\n")
+	}
+	return out.String()
+}
+
+// transcriptMeta renders YAML front matter describing an exported
+// conversation, with the estimated tokens per role
+func transcriptMeta(messages []Message, model string, exported time.Time) string {
+	tokens := map[string]int{}
+	total := 0
+	for _, msg := range messages {
+		n := estimateTokens(msg.Content)
+		tokens[msg.Role] += n
+		total += n
+	}
+
+	out := &strings.Builder{}
+	out.WriteString("---\n")
+	fmt.Fprintf(out, "model: %s\n", strconv.Quote(model))
+	fmt.Fprintf(out, "exported: %s\n", exported.Format(time.RFC3339))
+	fmt.Fprintf(out, "messages: %d\n", len(messages))
+	out.WriteString("estimated_tokens:\n")
+	fmt.Fprintf(out, "  total: %d\n", total)
+	for _, role := range []string{"system", "user", "assistant"} {
+		fmt.Fprintf(out, "  %s: %d\n", role, tokens[role])
+	}
+	out.WriteString("---\n\n")
+	return out.String()
+}
+
+// ExportConversation writes the conversation to path as Markdown, prefixed
+// with front matter from transcriptMeta when withMeta is set. An empty path
+// exports to a timestamped file in the current directory.
+func (ui *ChatUI) ExportConversation(path string, withMeta bool) {
+	now := time.Now()
+	if path == "" {
+		path = now.Format("conversation-20060102-150405.md")
+	}
+
+	transcript := formatTranscript(ui.messages)
+	if withMeta {
+		transcript = transcriptMeta(ui.messages, ui.cfg.OpenRouter.Model, now) + transcript
+	}
+	if err := os.WriteFile(path, []byte(transcript), 0o644); err != nil {
+		ui.AppendToChat("System", "Error: failed to export conversation: "+tview.Escape(err.Error()))
+		return
+	}
+	ui.AppendToChat("System", "Conversation exported to "+tview.Escape(path))
+}
+
+// maxImageSize is the largest image /image attaches
+const maxImageSize = 5 << 20
+
+// imageTypes maps the supported image extensions to their MIME types
+var imageTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// AttachImage reads a local image and attaches it to the next user message
+// as a base64 data URL
+func (ui *ChatUI) AttachImage(path string) {
+	mimeType, ok := imageTypes[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		ui.AppendToChat("System", tview.Escape(fmt.Sprintf("Error: unsupported image type %q, use PNG, JPEG, GIF or WebP",
+			filepath.Ext(path))))
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		ui.AppendToChat("System", "Error: failed to read image: "+tview.Escape(err.Error()))
+		return
+	}
+	if info.Size() > maxImageSize {
+		ui.AppendToChat("System", fmt.Sprintf("Error: image is %d KB, the limit is %d KB",
+			info.Size()>>10, maxImageSize>>10))
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		ui.AppendToChat("System", "Error: failed to read image: "+tview.Escape(err.Error()))
+		return
+	}
+
+	dataURL := "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	ui.pendingImages = append(ui.pendingImages, dataURL)
+	ui.AppendToChat("System", fmt.Sprintf("Attached %s, it will be sent with your next message",
+		tview.Escape(filepath.Base(path))))
+}
+
+// ShowTokenBreakdown lists the estimated tokens of every message in the
+// conversation, using the same estimate as the status bar
+func (ui *ChatUI) ShowTokenBreakdown() {
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "Estimated tokens per message:\n%3s  %-9s %7s  %s\n", "#", "Role", "Tokens", "Content")
+	sent := ui.templatedMessages(ui.messages)
+	for i, msg := range ui.messages {
+		preview := []rune(strings.Join(strings.Fields(msg.Content), " "))
+		if len(preview) > 40 {
+			preview = append(preview[:39], '…')
+		}
+		fmt.Fprintf(out, "%3d  %-9s %7d  %s\n", i+1, msg.Role, estimateTokens(sent[i].Content),
+			tview.Escape(string(preview)))
+	}
+	fmt.Fprintf(out, "%3s  %-9s %7d", "", "Total", ui.conversationTokens())
+	ui.AppendToChat("System", out.String())
+}
+
+// EditLastMessage removes the last user message and the reply to it from the
+// conversation and puts the message back in the input field for resending
+func (ui *ChatUI) EditLastMessage() {
+	if ui.isLoading() {
+		ui.AppendToChat("System", "Error: wait for the current response before editing")
+		return
+	}
+
+	last := ui.lastUserMessage()
+	if last < 0 {
+		ui.AppendToChat("System", "Nothing to edit: no message has been sent yet")
+		return
+	}
+
+	msg := ui.messages[last]
+	ui.messages = ui.messages[:last]
+	ui.pendingImages = msg.Images
+	ui.renderConversation()
+	if msg.Model != "" {
+		msg.Content = "@" + msg.Model + " " + msg.Content
+	}
+	ui.inputField.SetText(msg.Content)
+	ui.SetStatus("Editing last message")
+}
+
+// UndoLastExchange removes the last user message and the reply to it from
+// the conversation and the chat view. It does nothing when no message has
+// been sent.
+func (ui *ChatUI) UndoLastExchange() {
+	if ui.isLoading() {
+		ui.AppendToChat("System", "Error: wait for the current response before undoing")
+		return
+	}
+
+	last := ui.lastUserMessage()
+	if last < 0 {
+		ui.SetStatus("Nothing to undo")
+		return
+	}
+	ui.messages = ui.messages[:last]
+	// The usage reported last counted the removed exchange
+	ui.lastUsage = nil
+	ui.renderConversation()
+	ui.SetStatus("Removed the last exchange")
+}
+
+// lastUserMessage returns the index of the last user message, or -1 if there is none
+func (ui *ChatUI) lastUserMessage() int {
+	for i := len(ui.messages) - 1; i >= 0; i-- {
+		if ui.messages[i].Role == "user" {
+			return i
+		}
+	}
+	return -1
+}
+
+// exchangeModel returns the @model override the last user message was sent
+// to, or "" for the configured model
+func (ui *ChatUI) exchangeModel() string {
+	if last := ui.lastUserMessage(); last >= 0 {
+		return ui.messages[last].Model
+	}
+	return ""
+}
+
+// RetryLastResponse drops the last assistant reply and requests a new one
+// from the model that gave it
+func (ui *ChatUI) RetryLastResponse() {
+	if len(ui.messages) == 0 || ui.messages[len(ui.messages)-1].Role != "assistant" {
+		ui.AppendToChat("System", "Nothing to retry: the last message is not an assistant response")
+		return
+	}
+
+	ui.messages = ui.messages[:len(ui.messages)-1]
+	ui.AppendToChat("System", "[gray](previous response replaced)[-]")
+	ui.sendConversation(ui.exchangeModel())
+}
+
+// continuePrompt asks the model to pick up where its last response stopped
+const continuePrompt = "Continue your previous response exactly where it stopped. " +
+	"Don't repeat any of it or add a preamble."
+
+// ContinueResponse asks the model to continue the last assistant reply, e.g.
+// one cut off at max_tokens, and appends the continuation to it
+func (ui *ChatUI) ContinueResponse() {
+	if len(ui.messages) == 0 || ui.messages[len(ui.messages)-1].Role != "assistant" {
+		ui.AppendToChat("System", "Nothing to continue: the last message is not an assistant response")
+		return
+	}
+	ui.continuation = ui.messages[len(ui.messages)-1].Content
+	ui.sendConversation(ui.exchangeModel())
+}
+
+// Command describes a slash command for /help and the command palette
+type Command struct {
+	Name        string
+	Args        string // Usage of the arguments, empty if there are none
+	Description string
+}
+
+// commands lists the slash commands handled by handleCommand
+var commands = []Command{
+	{"/help", "", "List the available commands"},
+	{"/clear", "", "Start a new conversation"},
+	{"/model", "[name]", "Show or switch the model"},
+	{"/models", "[filter]", "List the models whose id contains filter"},
+	{"/system", "[prompt]", "Show or hide the system prompt, or set it"},
+	{"/edit", "", "Edit and resend the last message"},
+	{"/undo", "", "Remove the last message and the reply to it"},
+	{"/retry", "", "Replace the last response with a new one"},
+	{"/continue", "", "Continue the last response where it stopped"},
+	{"/summarize", "", "Replace the conversation with a summary of it"},
+	{"/tokens", "", "Show the token usage per message"},
+	{"/image", "<path>", "Attach an image to the next message"},
+	{"/find", "<text>", "Search the conversation, also / <text>"},
+	{"/theme", "[name]", "List or switch color themes"},
+	{"/json", "[on|off]", "Show or switch JSON responses"},
+	{"/raw", "", "Toggle showing responses verbatim instead of rendered"},
+	{"/seed", "[n|off]", "Show, set or clear the sampling seed"},
+	{"/save", "<name>", "Save the conversation as a named session"},
+	{"/load", "<name>", "Load a named session"},
+	{"/sessions", "", "List the saved sessions"},
+	{"/export", "[--with-meta] [path]", "Export the conversation as Markdown"},
+}
+
+// ShowHelp lists the slash commands with their descriptions
+func (ui *ChatUI) ShowHelp() {
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "\n  %s — %s", tview.Escape(strings.TrimSpace(cmd.Name+" "+cmd.Args)), cmd.Description)
+	}
+	b.WriteString("\nStart a message with // to send it with a leading /.")
+	b.WriteString("\nPress Ctrl+Space to pick a command from a list.")
+	if ui.cfg.Keys.Focus.bound {
+		fmt.Fprintf(&b, "\nPress %s to move between the conversation and the input.", tview.Escape(ui.cfg.Keybindings.Focus))
+	}
+	ui.AppendToChat("System", b.String())
+}
+
+// fuzzyMatch reports whether the characters of query appear in s in order,
+// ignoring case
+func fuzzyMatch(query, s string) bool {
+	s = strings.ToLower(s)
+	for _, r := range strings.ToLower(query) {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+utf8.RuneLen(r):]
+	}
+	return true
+}
+
+// ShowCommandPalette opens a fuzzy-filtered list of the slash commands.
+// Selecting one puts it in the input field, ready for its arguments.
+func (ui *ChatUI) ShowCommandPalette() {
+	list := tview.NewList()
+	filter := tview.NewInputField().SetLabel("Filter: ")
+
+	closePalette := func() {
+		ui.pages.RemovePage("commands")
+		ui.app.SetFocus(ui.inputField)
+	}
+	populate := func(query string) {
+		list.Clear()
+		for _, cmd := range commands {
+			if !fuzzyMatch(query, cmd.Name) {
+				continue
+			}
+			text := cmd.Name
+			if cmd.Args != "" {
+				text += " "
+			}
+			list.AddItem(tview.Escape(strings.TrimSpace(cmd.Name+" "+cmd.Args)), cmd.Description, 0, func() {
+				closePalette()
+				ui.inputField.SetText(text)
 			})
-			frameIdx = (frameIdx + 1) % len(frames)
-			time.Sleep(100 * time.Millisecond)
 		}
-	}()
+	}
+	populate("")
+
+	filter.SetChangedFunc(populate)
+	filter.SetDoneFunc(func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEscape:
+			closePalette()
+		case tcell.KeyEnter:
+			if list.GetItemCount() > 0 {
+				list.GetItemSelectedFunc(list.GetCurrentItem())()
+			}
+		}
+	})
+	filter.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyDown || event.Key() == tcell.KeyTab {
+			ui.app.SetFocus(list)
+			return nil
+		}
+		return event
+	})
+	list.SetDoneFunc(closePalette)
+
+	box := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(filter, 1, 0, true).
+		AddItem(list, 0, 1, false)
+	box.SetBorder(true).SetTitle(" Commands (Esc to close) ")
+	ui.applyPopupTheme(box, filter, list)
+
+	ui.pages.AddPage("commands", centered(box, 70, 24), true, true)
+	ui.app.SetFocus(filter)
+}
+
+// handleCommand runs a slash command and reports whether the input was consumed
+func (ui *ChatUI) handleCommand(input string) bool {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return false
+	}
+
+	switch fields[0] {
+	case "/help":
+		ui.ShowHelp()
+	case "/clear":
+		ui.ClearConversation()
+	case "/model":
+		if len(fields) < 2 {
+			ui.AppendToChat("System", "Current model: "+ui.cfg.OpenRouter.Model)
+			break
+		}
+		ui.SetModel(fields[1])
+	case "/models":
+		ui.ListModels(strings.TrimSpace(strings.TrimPrefix(input, "/models")))
+	case "/system":
+		prompt := strings.TrimSpace(strings.TrimPrefix(input, "/system"))
+		if prompt == "" {
+			ui.ToggleSystemHeader()
+			break
+		}
+		ui.SetSystemPrompt(prompt)
+	case "/edit":
+		ui.EditLastMessage()
+	case "/undo":
+		ui.UndoLastExchange()
+	case "/summarize":
+		ui.SummarizeConversation()
+	case "/retry":
+		ui.RetryLastResponse()
+	case "/continue":
+		ui.ContinueResponse()
+	case "/theme":
+		if len(fields) < 2 {
+			ui.AppendToChat("System", "Available themes: "+strings.Join(themeNames(), ", "))
+			break
+		}
+		ui.SetTheme(fields[1])
+	case "/seed":
+		if len(fields) < 2 {
+			if seed := ui.cfg.OpenRouter.Seed; seed != nil {
+				ui.AppendToChat("System", fmt.Sprintf("Seed: %d", *seed))
+			} else {
+				ui.AppendToChat("System", "No seed set")
+			}
+			break
+		}
+		ui.SetSeed(fields[1])
+	case "/raw":
+		ui.ToggleMarkdown()
+	case "/json":
+		switch {
+		case len(fields) < 2:
+			state := "off"
+			if ui.jsonMode() {
+				state = "on"
+			}
+			ui.AppendToChat("System", "JSON mode is "+state)
+		case fields[1] == "on" || fields[1] == "off":
+			ui.SetJSONMode(fields[1] == "on")
+		default:
+			ui.AppendToChat("System", "Usage: /json [on|off]")
+		}
+	case "/save", "/load":
+		if len(fields) < 2 {
+			ui.AppendToChat("System", fmt.Sprintf("Usage: %s <name>", fields[0]))
+			break
+		}
+		if fields[0] == "/save" {
+			ui.SaveSession(fields[1])
+		} else {
+			ui.LoadSession(fields[1])
+		}
+	case "/sessions":
+		ui.ListSessions()
+	case "/tokens":
+		ui.ShowTokenBreakdown()
+	case "/image":
+		path := strings.TrimSpace(strings.TrimPrefix(input, "/image"))
+		if path == "" {
+			ui.AppendToChat("System", "Usage: /image <path>")
+			break
+		}
+		ui.AttachImage(path)
+	case "/export":
+		path := strings.TrimSpace(strings.TrimPrefix(input, "/export"))
+		withMeta := path == "--with-meta" || strings.HasPrefix(path, "--with-meta ")
+		if withMeta {
+			path = strings.TrimSpace(strings.TrimPrefix(path, "--with-meta"))
+		}
+		ui.ExportConversation(path, withMeta)
+	case "/", "/find":
+		query := strings.TrimSpace(strings.TrimPrefix(input, fields[0]))
+		if query == "" {
+			ui.AppendToChat("System", "Usage: / <text>")
+			break
+		}
+		ui.StartSearch(query)
+	default:
+		// Other text starting with a slash, such as a path, is a message
+		if !commandNamePattern.MatchString(fields[0]) {
+			return false
+		}
+		ui.AppendToChat("System", tview.Escape(fmt.Sprintf(
+			"Unknown command %s, see /help, or start with // to send it as a message", fields[0])))
+	}
+	return true
+}
+
+func (ui *ChatUI) handleInput(input string) {
+	ui.ExitSearch()
+	// A doubled slash sends the input as a message starting with one slash
+	if rest, ok := strings.CutPrefix(input, "//"); ok {
+		input = "/" + rest
+	} else if strings.HasPrefix(input, "/") && ui.handleCommand(input) {
+		return
+	}
+
+	model, input := parseModelOverride(input)
+	if limit := ui.cfg.OpenRouter.ConfirmAboveTokens; limit > 0 {
+		if tokens := ui.conversationTokens() + estimateTokens(ui.templatedContent(input)); tokens > limit {
+			ui.confirmSend(input, model, tokens)
+			return
+		}
+	}
+	ui.sendUserMessage(input, model)
+}
+
+// parseModelOverride splits an "@provider/name message" input into the model
+// and the message. Input without a valid model prefix is returned as is with
+// an empty model, so the configured model is used.
+func parseModelOverride(input string) (model, content string) {
+	m := modelOverridePattern.FindStringSubmatch(input)
+	if m == nil || !modelSlugPattern.MatchString(m[1]) {
+		return "", input
+	}
+	return m[1], m[2]
+}
+
+// sendUserMessage adds the user's message to the conversation and sends it
+// to model, or to the configured model when model is empty
+func (ui *ChatUI) sendUserMessage(input, model string) {
+	ui.app.SetFocus(ui.inputField)
+	ui.AddMessage("user", input)
+	ui.messages[len(ui.messages)-1].Model = model
+	ui.AppendToChat("You", input)
+	if len(ui.pendingImages) > 0 {
+		ui.messages[len(ui.messages)-1].Images = ui.pendingImages
+		ui.AppendToChat("System", fmt.Sprintf("Sent with %d attached image(s)", len(ui.pendingImages)))
+		ui.pendingImages = nil
+	}
+	if model != "" {
+		ui.AppendToChat("System", "Sending this message to "+model)
+	}
+	ui.trimContext()
+	ui.sendConversation(model)
+}
+
+// templatedMessages returns messages with each user message substituted
+// into prompt_template, or messages as they are when no template is set
+func (ui *ChatUI) templatedMessages(messages []Message) []Message {
+	tmpl := ui.cfg.OpenRouter.PromptTemplate
+	if tmpl == "" {
+		return messages
+	}
+	templated := make([]Message, len(messages))
+	for i, msg := range messages {
+		if msg.Role == "user" {
+			msg.Content = ui.templatedContent(msg.Content)
+		}
+		templated[i] = msg
+	}
+	return templated
 }
 
-func (ui *ChatUI) StopLoading() {
-	ui.mu.Lock()
-	defer ui.mu.Unlock()
-	ui.loadingActive = false
-	ui.inputField.SetDisabled(false)
-	ui.app.SetFocus(ui.inputField)
+// templatedContent substitutes a user message into prompt_template
+func (ui *ChatUI) templatedContent(content string) string {
+	if tmpl := ui.cfg.OpenRouter.PromptTemplate; tmpl != "" {
+		return strings.ReplaceAll(tmpl, promptPlaceholder, content)
+	}
+	return content
 }
 
-func (ui *ChatUI) AddMessage(role, content string) {
-	ui.messages = append(ui.messages, Message{Role: role, Content: content})
-}
+// trimContext drops the oldest messages until the conversation fits in
+// max_context_tokens. System messages and the latest user message are kept.
+func (ui *ChatUI) trimContext() {
+	limit := ui.cfg.OpenRouter.MaxContextTokens
+	if limit <= 0 {
+		return
+	}
 
-// AppendToChat renders and displays a message in the chat view
-func (ui *ChatUI) AppendToChat(role, text string) {
-	switch role {
-	case "You":
-		fmt.Fprintf(ui.chatHistory, "[purple]You:[-] [white]%s\n", text)
-	case "Assistant":
-		formatted := ui.markdownParser.RenderMarkdown(text)
-		fmt.Fprintf(ui.chatHistory, "[blue]Assistant:[-] %s\n", formatted)
-	case "System":
-		fmt.Fprintf(ui.chatHistory, "[red]System:[-] %s\n", text)
-	default:
-		fmt.Fprintf(ui.chatHistory, "[white]%s:[-] %s\n", role, text)
+	lastUser := -1
+	for i, msg := range ui.messages {
+		if msg.Role == "user" {
+			lastUser = i
+		}
+	}
+
+	dropped := 0
+	for ui.conversationTokens() > limit {
+		oldest := -1
+		for i, msg := range ui.messages[:max(lastUser, 0)] {
+			if msg.Role != "system" {
+				oldest = i
+				break
+			}
+		}
+		if oldest < 0 {
+			break
+		}
+		ui.messages = append(ui.messages[:oldest], ui.messages[oldest+1:]...)
+		lastUser--
+		dropped++
+	}
+
+	if dropped > 0 {
+		ui.AppendToChat("System", fmt.Sprintf("Dropped %d of the oldest messages to stay under %d tokens", dropped, limit))
 	}
-	ui.chatHistory.ScrollToEnd()
 }
 
-// AppendPartial appends streaming text with markdown applied
-func (ui *ChatUI) AppendPartialAssistant(text string) {
-	// Render partial markdown for streaming
-	formatted := ui.markdownParser.RenderPartial(text)
-	fmt.Fprintf(ui.chatHistory, "[blue]Assistant:[-] %s", formatted)
-	ui.chatHistory.ScrollToEnd()
+// confirmSend asks before sending a message that takes the conversation over
+// confirm_above_tokens. Declining puts the message back in the input field.
+func (ui *ChatUI) confirmSend(input, model string, tokens int) {
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("The conversation is about %d tokens, above the limit of %d.\nSend anyway?",
+			tokens, ui.cfg.OpenRouter.ConfirmAboveTokens)).
+		AddButtons([]string{"Send", "Cancel"}).
+		SetDoneFunc(func(_ int, label string) {
+			ui.pages.RemovePage("confirm")
+			ui.app.SetFocus(ui.inputField)
+			if label == "Send" {
+				ui.sendUserMessage(input, model)
+				return
+			}
+			if model != "" {
+				input = "@" + model + " " + input
+			}
+			ui.inputField.SetText(input)
+		})
+	ui.pages.AddPage("confirm", modal, true, true)
+	ui.app.SetFocus(modal)
 }
 
-func (ui *ChatUI) handleInput(input string) {
-	ui.AddMessage("user", input)
-	ui.AppendToChat("You", input)
+// streamFlushInterval is how often streamed deltas are drawn. Deltas that
+// arrive in between are coalesced so fast models don't redraw per token.
+const streamFlushInterval = 50 * time.Millisecond
+
+// sendConversation sends the conversation to model, or to the configured
+// model when model is empty, and streams the reply into the chat
+func (ui *ChatUI) sendConversation(model string) {
+	if model == "" {
+		model = ui.cfg.OpenRouter.Model
+	}
 	ui.StartLoading()
+	// The status follows the request: Connecting until the first token,
+	// then Streaming (or Buffering for a whole response), then Finalizing
+	ui.SetStatus("Connecting...")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ui.mu.Lock()
+	ui.cancelRequest = cancel
+	ui.mu.Unlock()
+
+	// An @model override is sent with that model's profile and timeout
+	profile := ui.modelProfile(model)
+	client := ui.clientFor(model)
+
+	// The instruction to continue is only sent, the continuation is stored
+	// as part of the response it extends
+	messages := ui.templatedMessages(ui.messages)
+	continuing := ui.continuation != ""
+	if continuing {
+		messages = append(slices.Clip(messages), Message{Role: "user", Content: continuePrompt})
+	}
 
 	go func() {
+		defer cancel()
+
 		reqBody := CompletionRequest{
-			Model:     ui.cfg.OpenRouter.Model,
-			Messages:  ui.messages,
-			Stream:    true,
-			MaxTokens: ui.cfg.OpenRouter.MaxTokens,
+			Model:       model,
+			Models:      ui.cfg.OpenRouter.FallbackModels,
+			Messages:    messages,
+			Stream:      ui.cfg.OpenRouter.Stream,
+			MaxTokens:   profile.MaxTokens,
+			Temperature: profile.Temperature,
+			TopP:        profile.TopP,
+
+			FrequencyPenalty: ui.cfg.OpenRouter.FrequencyPenalty,
+			PresencePenalty:  ui.cfg.OpenRouter.PresencePenalty,
+			Stop:             ui.cfg.OpenRouter.Stop,
+			Seed:             ui.cfg.OpenRouter.Seed,
+			Transforms:       ui.cfg.OpenRouter.Transforms,
+			Provider:         ui.cfg.OpenRouter.Provider,
+		}
+		if ui.jsonMode() {
+			reqBody.ResponseFormat = &ResponseFormat{Type: "json_object"}
+		}
+		if reqBody.Stream {
+			reqBody.StreamOptions = &StreamOptions{IncludeUsage: true}
 		}
 
 		jsonBody, err := json.Marshal(reqBody)
@@ -424,46 +4491,111 @@ func (ui *ChatUI) handleInput(input string) {
 			return
 		}
 
-		req, err := http.NewRequest("POST", "https://openrouter.ai/api/v1/chat/completions",
-			bytes.NewReader(jsonBody))
-		if err != nil {
-			ui.handleStreamError("Request creation error: " + err.Error())
-			return
+		// The body reader is consumed by each attempt, so requests are rebuilt on retry
+		newRequest := func(apiKey string) (*http.Request, error) {
+			return ui.newCompletionRequest(ctx, apiKey, jsonBody)
 		}
 
-		// Trim API key
-		apiKey := strings.TrimSpace(ui.cfg.OpenRouter.APIKey)
-
-		req.Header.Set("Authorization", "Bearer "+apiKey)
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("HTTP-Referer", "github.com/reVost/go-openrouter")
-		req.Header.Set("X-Title", "Go OpenRouter Client")
-
-		log.Printf("Using model: %s", ui.cfg.OpenRouter.Model)
-		if len(apiKey) > 8 {
-			log.Printf("Using API key: %s...%s", apiKey[:4], apiKey[len(apiKey)-4:])
+		log.Printf("Using model: %s", model)
+		if ui.cfg.OpenRouter.LogFile != "" {
+			log.Printf("Request: POST %s %s", ui.apiURL("/chat/completions"), jsonBody)
 		}
 
-		resp, err := ui.client.Do(req)
+		resp, err := ui.doWithRetry(ctx, client, newRequest)
 		if err != nil {
+			if ctx.Err() != nil {
+				ui.app.QueueUpdateDraw(func() {
+					ui.StopLoading()
+					ui.AppendToChat("System", "Request cancelled")
+				})
+				return
+			}
 			ui.handleStreamError("API request error: " + err.Error())
 			return
 		}
 		defer resp.Body.Close()
 
+		rateLimit := parseRateLimit(resp.Header)
+		ui.app.QueueUpdate(func() {
+			ui.rateLimit = rateLimit
+		})
+
 		if resp.StatusCode != http.StatusOK {
 			errBody, _ := io.ReadAll(resp.Body)
-			ui.handleStreamError(fmt.Sprintf("API error (%d): %s", resp.StatusCode, string(errBody)))
+			ui.handleStreamError(fmt.Sprintf("API error (%d): %s", resp.StatusCode, apiErrorMessage(errBody)))
+			// Models without JSON mode reject the request as invalid
+			if reqBody.ResponseFormat != nil && resp.StatusCode == http.StatusBadRequest {
+				ui.app.QueueUpdateDraw(func() {
+					ui.AppendToChat("System", fmt.Sprintf(
+						"Warning: %s may not support JSON mode, turn it off with /json off", tview.Escape(model)))
+				})
+			}
+			return
+		}
+
+		if !reqBody.Stream {
+			ui.readFullResponse(ctx, resp.Body)
 			return
 		}
 
 		reader := bufio.NewReader(resp.Body)
-		var responseStarted bool
+		var (
+			responseStarted bool
+			streamDone      bool // [DONE] arrived, so the response is complete
+			usage           *Usage
+			provider        string
+			servedModel     string
+			finishReason    string
+			stalled         atomic.Bool
+		)
+
+		// Abort the stream when no data arrives for idle_timeout seconds
+		resetStallTimer := func() {}
+		if idleTimeout := time.Duration(ui.cfg.OpenRouter.IdleTimeout) * time.Second; idleTimeout > 0 {
+			stallTimer := time.AfterFunc(idleTimeout, func() {
+				stalled.Store(true)
+				cancel()
+			})
+			defer stallTimer.Stop()
+			resetStallTimer = func() { stallTimer.Reset(idleTimeout) }
+		}
+
+		// Deltas wait in pending until the flush timer draws them in one update
+		var (
+			pendingMu        sync.Mutex
+			pending          strings.Builder
+			pendingReasoning strings.Builder
+			flushTimer       *time.Timer
+		)
+		flush := func() {
+			pendingMu.Lock()
+			defer pendingMu.Unlock()
+			flushTimer = nil
+			if pending.Len() == 0 && pendingReasoning.Len() == 0 {
+				return
+			}
+			delta, reasoning := pending.String(), pendingReasoning.String()
+			pending.Reset()
+			pendingReasoning.Reset()
+			// Queued under the lock so flushes reach the UI in order
+			ui.app.QueueUpdateDraw(func() {
+				if reasoning != "" {
+					ui.AppendReasoning(reasoning)
+				}
+				if delta != "" {
+					ui.AppendPartialAssistant(delta)
+				}
+			})
+		}
 
 		for {
 			line, err := reader.ReadString('\n')
+			resetStallTimer()
+			if ui.cfg.OpenRouter.LogFile != "" && line != "" {
+				log.Printf("Stream: %s", strings.TrimRight(line, "\r\n"))
+			}
 			if err != nil {
-				if errors.Is(err, io.EOF) {
+				if errors.Is(err, io.EOF) || ctx.Err() != nil {
 					break
 				}
 				log.Printf("Stream read error: %v", err)
@@ -480,6 +4612,7 @@ func (ui *ChatUI) handleInput(input string) {
 				jsonStr = strings.TrimSpace(jsonStr)
 
 				if jsonStr == "[DONE]" {
+					streamDone = true
 					break
 				}
 
@@ -489,52 +4622,534 @@ func (ui *ChatUI) handleInput(input string) {
 					continue
 				}
 
-				if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
-					delta := chunk.Choices[0].Delta.Content
+				if chunk.Usage != nil {
+					usage = chunk.Usage
+				}
+				if chunk.Provider != "" {
+					provider = chunk.Provider
+				}
+				if chunk.Model != "" {
+					servedModel = chunk.Model
+				}
+
+				if len(chunk.Choices) == 0 {
+					continue
+				}
+				if reason := chunk.Choices[0].FinishReason; reason != "" {
+					finishReason = reason
+				}
+				delta := chunk.Choices[0].Delta.Content
+				// Reasoning is only shown before the answer starts
+				reasoning := chunk.Choices[0].Delta.Reasoning
+				if !ui.cfg.OpenRouter.ShowReasoning || ui.assistantText.Len() > 0 || continuing {
+					reasoning = ""
+				}
+
+				if delta != "" || reasoning != "" {
 					ui.assistantText.WriteString(delta)
 
+					pendingMu.Lock()
 					if !responseStarted {
 						responseStarted = true
-						ui.app.QueueUpdateDraw(func() {
-							ui.AppendPartialAssistant(delta)
-						})
-					} else {
-						ui.app.QueueUpdateDraw(func() {
-							ui.AppendPartialAssistant(delta)
+						ui.app.QueueUpdate(func() {
+							ui.StartAssistantMessage()
+							ui.SetStatus("Streaming...")
 						})
 					}
+					pending.WriteString(delta)
+					pendingReasoning.WriteString(reasoning)
+					if flushTimer == nil {
+						flushTimer = time.AfterFunc(streamFlushInterval, flush)
+					}
+					pendingMu.Unlock()
 				}
 			}
 		}
 
+		// Draw whatever is still pending before the response is finished
+		ui.app.QueueUpdateDraw(func() {
+			ui.SetStatus("Finalizing...")
+		})
+		pendingMu.Lock()
+		if flushTimer != nil {
+			flushTimer.Stop()
+		}
+		pendingMu.Unlock()
+		flush()
+
+		timedOut := stalled.Load()
+		cancelled := ctx.Err() != nil && !timedOut
+		truncated := !streamDone && !timedOut && !cancelled
 		ui.app.QueueUpdateDraw(func() {
-			// Add full message with final markdown rendering
+			// The response is already on screen, only the held back tail is left
 			finalResponse := ui.assistantText.String()
+			if responseStarted {
+				ui.FinishAssistantMessage()
+				if streamDone {
+					ui.showJSONResponse(ui.continuation + finalResponse)
+				}
+			}
 			if finalResponse != "" {
-				ui.AddMessage("assistant", finalResponse)
-				ui.AddCompletedAssistantMessage(finalResponse)
-			} else if !responseStarted {
+				ui.addResponse(finalResponse)
+				ui.autosave()
+			}
+			// Falls back to the estimate when the endpoint doesn't report usage
+			ui.lastUsage = usage
+			ui.setServedBy(provider, servedModel)
+
+			completed := false
+			if timedOut {
+				ui.AppendToChat("System", fmt.Sprintf("Error: stream stalled, no data received for %ds",
+					ui.cfg.OpenRouter.IdleTimeout))
+			} else if cancelled {
+				ui.AppendToChat("System", "Request cancelled")
+			} else if truncated && finalResponse != "" {
+				ui.AppendToChat("System", tview.Escape("[truncated]")+
+					" The connection closed before the response was complete, use /retry to regenerate it")
+			} else if finalResponse == "" {
 				ui.AppendToChat("System", "Assistant returned an empty response")
+			} else {
+				completed = true
+			}
+			if note := finishReasonNote(finishReason); note != "" && !timedOut && !cancelled {
+				ui.AppendToChat("System", note)
+			}
+
+			ui.StopLoading()
+			if completed {
+				ui.SetStatus(ui.durationStatus())
+			} else {
+				ui.SetStatus("Ready")
+			}
+		})
+	}()
+}
+
+// newCompletionRequest builds a chat completions request with the auth and
+// attribution headers
+func (ui *ChatUI) newCompletionRequest(ctx context.Context, apiKey string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", ui.apiURL("/chat/completions"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	ui.setHeaders(req, apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("HTTP-Referer", ui.cfg.OpenRouter.Referer)
+	req.Header.Set("X-Title", ui.cfg.OpenRouter.Title)
+	return req, nil
+}
+
+// setHeaders sets the configured custom headers and the Authorization header
+func (ui *ChatUI) setHeaders(req *http.Request, apiKey string) {
+	for name, value := range ui.cfg.OpenRouter.Headers {
+		req.Header.Set(strings.TrimSpace(name), value)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+}
+
+// summarizePrompt asks the model for the summary that /summarize keeps
+const summarizePrompt = "Summarize this conversation concisely. Keep the facts, decisions, open questions " +
+	"and any code or details needed to continue it. Reply with the summary only."
+
+// SummarizeConversation asks the model to summarize the conversation in a
+// separate request and replaces the messages with the summary
+func (ui *ChatUI) SummarizeConversation() {
+	if ui.isLoading() {
+		ui.AppendToChat("System", "Error: wait for the current response before summarizing")
+		return
+	}
+
+	var system, rest []Message
+	for _, msg := range ui.messages {
+		if msg.Role == "system" {
+			system = append(system, msg)
+		} else {
+			rest = append(rest, msg)
+		}
+	}
+	if len(rest) < 2 {
+		ui.AppendToChat("System", "Nothing to summarize yet")
+		return
+	}
+
+	reqBody := CompletionRequest{
+		Model:    ui.cfg.OpenRouter.Model,
+		Messages: append(slices.Clip(ui.templatedMessages(ui.messages)), Message{Role: "user", Content: summarizePrompt}),
+		Provider: ui.cfg.OpenRouter.Provider,
+		// A conversation long enough to summarize may need compressing
+		Transforms: ui.cfg.OpenRouter.Transforms,
+	}
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		ui.AppendToChat("System", "Error: request serialization error: "+tview.Escape(err.Error()))
+		return
+	}
+
+	ui.StartLoading()
+	ui.SetStatus("Summarizing...")
+	ctx, cancel := context.WithCancel(context.Background())
+	ui.mu.Lock()
+	ui.cancelRequest = cancel
+	ui.mu.Unlock()
+
+	client := ui.client
+	go func() {
+		defer cancel()
+
+		// The conversation is left as it was when the summary fails
+		fail := func(msg string) {
+			if ctx.Err() != nil {
+				ui.app.QueueUpdateDraw(func() {
+					ui.StopLoading()
+					ui.AppendToChat("System", "Request cancelled")
+					ui.SetStatus("Ready")
+				})
+				return
 			}
+			ui.handleStreamError(msg)
+		}
+
+		resp, err := ui.doWithRetry(ctx, client, func(apiKey string) (*http.Request, error) {
+			return ui.newCompletionRequest(ctx, apiKey, jsonBody)
+		})
+		if err != nil {
+			fail("Summary request error: " + err.Error())
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			errBody, _ := io.ReadAll(resp.Body)
+			fail(fmt.Sprintf("API error (%d): %s", resp.StatusCode, apiErrorMessage(errBody)))
+			return
+		}
+
+		var completion ChatCompletion
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			fail("Response parse error: " + err.Error())
+			return
+		}
+		summary := ""
+		if len(completion.Choices) > 0 {
+			summary = strings.TrimSpace(completion.Choices[0].Message.Content)
+		}
 
+		ui.app.QueueUpdateDraw(func() {
 			ui.StopLoading()
+			if summary == "" {
+				ui.AppendToChat("System", "Error: the model returned an empty summary")
+				ui.SetStatus("Ready")
+				return
+			}
+
+			summaryMsg := Message{Role: "assistant", Content: "Summary of the conversation so far:\n\n" + summary, Time: time.Now()}
+			ui.messages = append(system, summaryMsg)
+			ui.lastUsage = nil
+			ui.AppendToChat("System", fmt.Sprintf("Replaced %d messages with a summary", len(rest)))
+			ui.AppendToChat("Assistant", summaryMsg.Content)
+			ui.SetStatus("Conversation summarized")
 		})
 	}()
 }
 
-func (ui *ChatUI) AddCompletedAssistantMessage(text string) {
-	ui.AppendToChat("Assistant", text)
+// finishReasonNote explains a response that stopped before the model was
+// done, or returns "" when it finished normally
+func finishReasonNote(reason string) string {
+	switch reason {
+	case "length":
+		return "The response was cut off at the max_tokens limit of the request, " +
+			"raise max_tokens or use /continue to get the rest"
+	case "content_filter":
+		return "The response was stopped by the provider's content filter"
+	}
+	return ""
+}
+
+// readFullResponse reads a non-streamed completion and shows it all at once
+func (ui *ChatUI) readFullResponse(ctx context.Context, body io.Reader) {
+	ui.app.QueueUpdateDraw(func() {
+		ui.SetStatus("Buffering...")
+	})
+	var completion ChatCompletion
+	err := json.NewDecoder(body).Decode(&completion)
+	if err != nil && ctx.Err() == nil {
+		ui.handleStreamError("Response parse error: " + err.Error())
+		return
+	}
+
+	ui.app.QueueUpdateDraw(func() {
+		var content, reasoning string
+		if len(completion.Choices) > 0 {
+			content = completion.Choices[0].Message.Content
+			reasoning = completion.Choices[0].Message.Reasoning
+		}
+		if !ui.cfg.OpenRouter.ShowReasoning || ui.continuation != "" {
+			reasoning = ""
+		}
+
+		switch {
+		case ctx.Err() != nil:
+			ui.AppendToChat("System", "Request cancelled")
+		case content == "":
+			ui.AppendToChat("System", "Assistant returned an empty response")
+		default:
+			// Rendered like a finished stream, which matches AppendToChat
+			ui.StartAssistantMessage()
+			if reasoning != "" {
+				ui.AppendReasoning(reasoning)
+			}
+			ui.AppendPartialAssistant(content)
+			ui.FinishAssistantMessage()
+			ui.showJSONResponse(ui.continuation + content)
+			ui.addResponse(content)
+			ui.autosave()
+		}
+		if len(completion.Choices) > 0 && ctx.Err() == nil {
+			if note := finishReasonNote(completion.Choices[0].FinishReason); note != "" {
+				ui.AppendToChat("System", note)
+			}
+		}
+		ui.lastUsage = completion.Usage
+		ui.setServedBy(completion.Provider, completion.Model)
+
+		ui.StopLoading()
+		if content != "" && ctx.Err() == nil {
+			ui.SetStatus(ui.durationStatus())
+		} else {
+			ui.SetStatus("Ready")
+		}
+	})
+}
+
+// maxRetries is how many times a rate-limited or failed request is retried
+const maxRetries = 3
+
+// connectRetryDelay is how long to wait before retrying a failed connection
+const connectRetryDelay = 2 * time.Second
+
+// retryableStatus reports whether a response status is worth retrying
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// RateLimit is the request budget reported in X-RateLimit-* headers
+type RateLimit struct {
+	Limit     int // 0 when not reported
+	Remaining int
+	Reset     time.Time // Zero when not reported
+}
+
+// parseRateLimit reads the X-RateLimit-* headers of a response. It returns
+// nil when the remaining count isn't reported.
+func parseRateLimit(h http.Header) *RateLimit {
+	remaining, err := strconv.Atoi(strings.TrimSpace(h.Get("X-RateLimit-Remaining")))
+	if err != nil {
+		return nil
+	}
+	rl := &RateLimit{Remaining: remaining}
+	rl.Limit, _ = strconv.Atoi(strings.TrimSpace(h.Get("X-RateLimit-Limit")))
+
+	// The reset is sent as a Unix time in milliseconds or seconds, or as
+	// seconds from now
+	if reset, err := strconv.ParseInt(strings.TrimSpace(h.Get("X-RateLimit-Reset")), 10, 64); err == nil && reset > 0 {
+		switch {
+		case reset > 1e12:
+			rl.Reset = time.UnixMilli(reset)
+		case reset > 1e9:
+			rl.Reset = time.Unix(reset, 0)
+		default:
+			rl.Reset = time.Now().Add(time.Duration(reset) * time.Second)
+		}
+	}
+	return rl
+}
+
+// rateLimitWarnBelow is how many remaining requests trigger the warning when
+// the limit isn't reported; otherwise it is a tenth of the limit
+const rateLimitWarnBelow = 5
+
+// warning describes the remaining requests once they run low, or returns ""
+// when there are plenty left or the limit has since reset
+func (rl *RateLimit) warning(now time.Time) string {
+	if rl == nil || !rl.Reset.IsZero() && !now.Before(rl.Reset) {
+		return ""
+	}
+	threshold := rateLimitWarnBelow
+	if rl.Limit > 0 {
+		threshold = max(rl.Limit/10, 1)
+	}
+	if rl.Remaining > threshold {
+		return ""
+	}
+
+	warning := fmt.Sprintf("%d requests remaining", rl.Remaining)
+	if rl.Remaining == 1 {
+		warning = "1 request remaining"
+	}
+	if !rl.Reset.IsZero() {
+		warning += fmt.Sprintf(", resets in %s", rl.Reset.Sub(now).Round(time.Second))
+	}
+	return warning
+}
+
+// retryDelay returns the wait requested by a Retry-After header, or fallback
+// when the header is missing or unparsable
+func retryDelay(header string, fallback time.Duration) time.Duration {
+	if secs, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
+
+// nextAPIKey returns the position of the key the next request starts with,
+// rotating through the configured keys
+func (ui *ChatUI) nextAPIKey() int {
+	return int(ui.keyIndex.Add(1)-1) % len(ui.cfg.OpenRouter.APIKeys)
+}
+
+// doWithRetry sends a request, retrying 429/5xx responses with exponential
+// backoff. A key that is rejected or rate limited is first swapped for the
+// next configured key until every key has been tried.
+func (ui *ChatUI) doWithRetry(ctx context.Context, client *http.Client, newRequest func(apiKey string) (*http.Request, error)) (*http.Response, error) {
+	keys := ui.cfg.OpenRouter.APIKeys
+	current := ui.nextAPIKey()
+	triedKeys := 1
+	backoff := time.Second
+	attempt := 1
+	connectAttempt := 1
+	for {
+		apiKey := keys[current]
+		log.Printf("Using API key: %s", maskAPIKey(apiKey))
+		req, err := newRequest(apiKey)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			// No response at all, so retry on its own budget rather than the status retries
+			if ctx.Err() != nil || connectAttempt > ui.cfg.OpenRouter.ConnectRetries {
+				return nil, err
+			}
+			log.Printf("Connection failed, retrying in %s: %v", connectRetryDelay, err)
+			ui.app.QueueUpdateDraw(func() {
+				ui.SetStatus(fmt.Sprintf("Connection failed, retrying (%d/%d)...",
+					connectAttempt, ui.cfg.OpenRouter.ConnectRetries))
+			})
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(connectRetryDelay):
+			}
+			connectAttempt++
+			continue
+		}
+		if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusTooManyRequests) &&
+			triedKeys < len(keys) {
+			resp.Body.Close()
+			log.Printf("API returned %d for key %s, trying the next key", resp.StatusCode, maskAPIKey(apiKey))
+			current = (current + 1) % len(keys)
+			triedKeys++
+			continue
+		}
+		if !retryableStatus(resp.StatusCode) || attempt > maxRetries {
+			return resp, nil
+		}
+
+		wait := retryDelay(resp.Header.Get("Retry-After"), backoff)
+		resp.Body.Close()
+		log.Printf("API returned %d, retrying in %s", resp.StatusCode, wait)
+		ui.app.QueueUpdateDraw(func() {
+			ui.SetStatus(fmt.Sprintf("Retrying (%d/%d)...", attempt, maxRetries))
+		})
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+		attempt++
+	}
 }
 
 func (ui *ChatUI) handleStreamError(msg string) {
 	ui.app.QueueUpdateDraw(func() {
 		ui.StopLoading()
-		ui.AppendToChat("System", "Error: "+msg)
+		ui.SetStatus("Error")
+		// Server messages can hold brackets tview would take for tags
+		ui.AppendToChat("System", "Error: "+tview.Escape(msg))
 	})
 }
 
 func main() {
-	cfg, err := loadConfig()
+	configPath := flag.String("config", "",
+		"path to the config file (default: search ./config.yaml, $HOME/.openrouter/config.yaml and $XDG_CONFIG_HOME/openrouter/config.yaml)")
+	model := flag.String("model", "",
+		"model slug to use (precedence: flag > OPENROUTER_MODEL > config file)")
+	maxTokens := flag.Int("max-tokens", 0,
+		"maximum tokens per response (precedence: flag > OPENROUTER_MAX_TOKENS > config file)")
+	transcript := flag.String("transcript", "",
+		"print a saved history file as markdown and exit, without starting the chat")
+	offline := flag.Bool("offline", false,
+		"answer with a canned streamed reply instead of calling the API; no API key needed")
+	system := flag.String("system", "",
+		"system prompt to use (precedence: flag > OPENROUTER_SYSTEM_PROMPT > config file)")
+	promptFile := flag.String("prompt-file", "",
+		"send the contents of a file as the first message on startup")
+	showVersion := flag.Bool("version", false,
+		"print the version, commit and build date and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("openrouter-tui %s (commit %s, built %s)\n", version, commit, date)
+		return
+	}
+
+	// Printing a transcript needs neither the config nor the network
+	if *transcript != "" {
+		messages, err := readMessages(*transcript)
+		if err != nil {
+			log.Fatalf("Failed to load transcript: %v", err)
+		}
+		fmt.Print(formatTranscript(messages))
+		return
+	}
+
+	cfg, err := loadConfig(*configPath, *offline)
+	if notFound := (viper.ConfigFileNotFoundError{}); errors.As(err, &notFound) {
+		// Without a terminal to ask on, leave a placeholder to fill in
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			log.Println("Creating default config file...")
+			if err := writeConfig(defaultConfigFile, "your-api-key-here", defaultModel); err != nil {
+				log.Fatalf("Failed to write config: %v", err)
+			}
+			log.Printf("Created %s. Please update with your API key", defaultConfigFile)
+			log.Println("Rerun the application after setup")
+			os.Exit(0)
+		}
+
+		apiKey, model, setupErr := promptConfig(os.Stdin, os.Stdout)
+		if setupErr != nil {
+			log.Fatalf("Config setup failed: %v", setupErr)
+		}
+		if err := writeConfig(defaultConfigFile, apiKey, model); err != nil {
+			log.Fatalf("Failed to write config: %v", err)
+		}
+		fmt.Printf("Created %s\n", defaultConfigFile)
+		cfg, err = loadConfig(*configPath, *offline)
+	}
 	if err != nil {
 		log.Printf("Config error: %v", err)
 
@@ -543,44 +5158,56 @@ func main() {
 			log.Println("You can get your API key at: https://openrouter.ai/keys")
 			os.Exit(1)
 		}
+		log.Fatalf("Fatal config error: %v", err)
+	}
 
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			log.Println("Creating default config file...")
-			if _, err := os.Stat("config.yaml"); os.IsNotExist(err) {
-				file, createErr := os.Create("config.yaml")
-				if createErr != nil {
-					log.Fatalf("Failed to create config file: %v", createErr)
-				}
-				file.Close()
-			}
-
-			v := viper.New()
-			v.SetConfigFile("config.yaml")
-			v.Set("openrouter", map[string]interface{}{
-				"api_key":    "your-api-key-here",
-				"model":      "openai/gpt-3.5-turbo",
-				"timeout":    30,
-				"max_tokens": 512,
-			})
+	// Flags take precedence over both the environment and the config file
+	if *model != "" {
+		if !modelSlugPattern.MatchString(*model) {
+			log.Fatalf("Invalid model %q, expected provider/name", *model)
+		}
+		cfg.OpenRouter.Model = *model
+	}
+	if *maxTokens > 0 {
+		cfg.OpenRouter.MaxTokens = *maxTokens
+		cfg.MaxTokensOverride = *maxTokens
+	}
+	if *system != "" {
+		cfg.OpenRouter.SystemPrompt = *system
+	}
 
-			if err := v.WriteConfig(); err != nil {
-				log.Fatalf("Failed to write config: %v", err)
-			}
+	var prompt string
+	if *promptFile != "" {
+		data, err := os.ReadFile(*promptFile)
+		if err != nil {
+			log.Fatalf("Failed to read prompt file: %v", err)
+		}
+		if prompt = strings.TrimSpace(string(data)); prompt == "" {
+			log.Fatalf("Prompt file %s is empty", *promptFile)
+		}
+	}
 
-			log.Println("Created config.yaml. Please update with your API key")
-			log.Println("Rerun the application after setup")
-			os.Exit(0)
-		} else {
-			log.Fatalf("Fatal config error: %v", err)
+	// Keep log output from drawing over the TUI when a log file is configured
+	if cfg.OpenRouter.LogFile != "" {
+		logFile, err := os.OpenFile(cfg.OpenRouter.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
 		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	}
 
 	log.Printf("Loaded model: %s", cfg.OpenRouter.Model)
-	if len(cfg.OpenRouter.APIKey) > 8 {
-		log.Printf("Using API key: %s...%s", cfg.OpenRouter.APIKey[:4], cfg.OpenRouter.APIKey[len(cfg.OpenRouter.APIKey)-4:])
+	if keys := cfg.OpenRouter.APIKeys; len(keys) > 1 {
+		log.Printf("Using %d API keys", len(keys))
+	} else {
+		log.Printf("Using API key: %s", maskAPIKey(cfg.OpenRouter.APIKey))
 	}
 
 	ui := NewChatUI(cfg)
+	ui.startupPrompt = prompt
+	ui.startupSystem = *system
 	if err := ui.Run(); err != nil {
 		log.Fatalf("UI Error: %v", err)
 	}
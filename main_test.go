@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// renderStreamed feeds text to p one rune at a time, as a stream would
+func renderStreamed(p *MarkdownParser, text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		b.Write(p.RenderPartial(string(r)))
+	}
+	b.Write(p.Flush())
+	return b.String()
+}
+
+func TestRenderPartialMatchesRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"inline code", "Use `fmt.Println` to print"},
+		{"code with markup inside", "Keep `x *y* z` literal"},
+		{"unclosed code span", "a `b c"},
+		{"code and emphasis", "**bold** then `code` then *it*"},
+		{"double backticks", "a `` b ` c `` d"},
+		{"lists", "- item `one`\n- item **two**\n1. first\n12. second"},
+		{"fenced code", "```go\nfunc main() {}\n```\nafter"},
+		{"unclosed fence", "```\nunclosed code"},
+		{"table", "| a | b |\n|---|---|\n| `x` | **y** |\nafter"},
+		{"quote", "> one `q`\n> two"},
+		{"escaped markup", "\\*not italic\\* and \\`not code\\`"},
+		{"heading spacing", "##   Title\n#  Title **b**\n###\t\tTabbed\n#   \n#hashtag\ntext"},
+		{"nested brackets", "[x[]] and [a[b]] and [red[]] and [longerword[]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := string(NewMarkdownParser().RenderMarkdown(tt.text))
+			if got := renderStreamed(NewMarkdownParser(), tt.text); got != want {
+				t.Errorf("streamed rendering differs\nstreamed: %q\nfull:     %q", got, want)
+			}
+		})
+	}
+}
+
+// newTestUI starts a chat UI on a simulation screen, configured by the YAML
+// in config, with its files kept in a temporary home directory
+func newTestUI(t *testing.T, config string) *ChatUI {
+	t.Helper()
+	ui := NewChatUI(testConfig(t, config))
+	runTestUI(t, ui)
+	return ui
+}
+
+// testConfig loads the YAML in config with a temporary home directory
+func testConfig(t *testing.T, config string) *Config {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("OPENROUTER_API_KEY", "")
+
+	path := filepath.Join(home, "config.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// runTestUI runs ui on a simulation screen until the test ends
+func runTestUI(t *testing.T, ui *ChatUI) {
+	t.Helper()
+	screen := tcell.NewSimulationScreen("UTF-8")
+	screen.SetSize(100, 40)
+	ui.app.SetScreen(screen)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := ui.Run(); err != nil {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() {
+		ui.app.Stop()
+		<-done
+	})
+	// Run sets the UI up before the event loop starts taking updates
+	onUI(ui, func() {})
+}
+
+// onUI runs f on the UI's event loop and waits for it to finish
+func onUI(ui *ChatUI, f func()) {
+	done := make(chan struct{}, 1)
+	ui.app.QueueUpdate(func() {
+		f()
+		done <- struct{}{}
+	})
+	<-done
+}
+
+// waitForResponse waits until the UI is no longer loading and has an
+// assistant reply
+func waitForResponse(t *testing.T, ui *ChatUI) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var done bool
+		onUI(ui, func() {
+			_, replied := ui.lastAssistantMessage()
+			done = replied && !ui.isLoading()
+		})
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the response")
+}
+
+// sseServer serves a streamed completion sending chunks as separate deltas
+func sseServer(t *testing.T, chunks []string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		for _, chunk := range chunks {
+			content, _ := json.Marshal(chunk)
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%s}}]}\n\n", content)
+			flusher.Flush()
+			// Spread the chunks over several draws
+			time.Sleep(streamFlushInterval)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamedResponseLabelAppearsOnce(t *testing.T) {
+	chunks := []string{"Hello", " there, ", "this **arrives**", " in `several`", " chunks.\n", "- and a list"}
+	srv := sseServer(t, chunks)
+	ui := newTestUI(t, fmt.Sprintf("openrouter:\n  api_key: sk-test\n  base_url: %s\n", srv.URL))
+
+	onUI(ui, func() { ui.sendUserMessage("hi", "") })
+	waitForResponse(t, ui)
+
+	var text, reply string
+	onUI(ui, func() {
+		text = ui.chatHistory.GetText(true)
+		reply, _ = ui.lastAssistantMessage()
+	})
+	if n := strings.Count(text, "Assistant:"); n != 1 {
+		t.Errorf("label shown %d times, want once in:\n%s", n, text)
+	}
+	if want := strings.Join(chunks, ""); reply != want {
+		t.Errorf("stored reply %q, want %q", reply, want)
+	}
+	if !strings.Contains(text, "Hello there, this arrives in several chunks.") {
+		t.Errorf("chunks not appended in order:\n%s", text)
+	}
+}
+
+func TestAPIErrorShownVerbatim(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"error envelope", `{"error":{"message":"Invalid model [foo]","code":400}}`, "Error: API error (400): Invalid model [foo]"},
+		{"raw body", `{"errors":["upstream"]}`, `Error: API error (400): {"errors":["upstream"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, tt.body, http.StatusBadRequest)
+			}))
+			defer srv.Close()
+			ui := newTestUI(t, fmt.Sprintf("openrouter:\n  api_key: sk-test\n  base_url: %s\n", srv.URL))
+
+			onUI(ui, func() { ui.sendUserMessage("hi", "") })
+			var text string
+			deadline := time.Now().Add(5 * time.Second)
+			for !strings.Contains(text, "Error:") && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				onUI(ui, func() { text = ui.chatHistory.GetText(true) })
+			}
+			if !strings.Contains(text, tt.want) {
+				t.Errorf("chat does not show %q:\n%s", tt.want, text)
+			}
+		})
+	}
+}
+
+func TestEmptyKeyBindingMatchesNothing(t *testing.T) {
+	binding, err := parseKeyBinding("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ctrl+Space is key 0, the zero value of tcell.Key
+	for _, event := range []*tcell.EventKey{
+		tcell.NewEventKey(tcell.KeyCtrlSpace, 0, tcell.ModCtrl),
+		tcell.NewEventKey(tcell.KeyCtrlL, 0, tcell.ModCtrl),
+	} {
+		if binding.Matches(event) {
+			t.Errorf("empty binding matches %s", event.Name())
+		}
+	}
+}
+
+func TestUnknownCommandNotSent(t *testing.T) {
+	srv := sseServer(t, []string{"ok"})
+	ui := newTestUI(t, fmt.Sprintf("openrouter:\n  api_key: sk-test\n  base_url: %s\n", srv.URL))
+
+	var text string
+	var sent int
+	onUI(ui, func() {
+		ui.handleInput("/claer")
+		text = ui.chatHistory.GetText(true)
+		sent = len(ui.messages)
+	})
+	if !strings.Contains(text, "Unknown command /claer") {
+		t.Errorf("unknown command not reported:\n%s", text)
+	}
+	if sent != 0 {
+		t.Errorf("unknown command sent as a message")
+	}
+
+	onUI(ui, func() { ui.handleInput("//claer is a typo") })
+	waitForResponse(t, ui)
+	onUI(ui, func() { text = ui.messages[0].Content })
+	if text != "/claer is a typo" {
+		t.Errorf("escaped message sent as %q", text)
+	}
+}
+
+func TestBlankLineSpacingMatchesWhenStreamed(t *testing.T) {
+	text := "one\n\n\n\ntwo\n\n- item\n\n\n- item\n```\na\n\n\nb\n```\n\n\n\n| a |\n|---|\n\n\nend\n\n\n"
+	for _, collapse := range []bool{true, false} {
+		t.Run(fmt.Sprintf("collapse %v", collapse), func(t *testing.T) {
+			newParser := func() *MarkdownParser {
+				p := NewMarkdownParser()
+				p.collapseBlankLines = collapse
+				return p
+			}
+			full := string(newParser().RenderMarkdown(text))
+			if streamed := renderStreamed(newParser(), text); streamed != full {
+				t.Errorf("streamed spacing differs\nstreamed: %q\nfull:     %q", streamed, full)
+			}
+
+			// Blank lines inside code blocks are kept either way
+			if strings.Count(full, "[::r]   [::-]") != 2 {
+				t.Errorf("blank lines in code block changed: %q", full)
+			}
+			between := full[strings.Index(full, "one"):strings.Index(full, "two")]
+			if want := map[bool]int{true: 2, false: 4}[collapse]; strings.Count(between, "\n") != want {
+				t.Errorf("%d line breaks between paragraphs, want %d: %q", strings.Count(between, "\n"), want, full)
+			}
+		})
+	}
+}
+
+func TestStartupPromptAsksToConfirm(t *testing.T) {
+	srv := sseServer(t, []string{"ok"})
+	cfg := testConfig(t, fmt.Sprintf(
+		"openrouter:\n  api_key: sk-test\n  base_url: %s\n  confirm_above_tokens: 1\n", srv.URL))
+	ui := NewChatUI(cfg)
+	ui.startupPrompt = "a prompt long enough to pass the limit"
+	ui.startupSystem = "Be brief"
+	runTestUI(t, ui)
+
+	var confirming bool
+	deadline := time.Now().Add(5 * time.Second)
+	for !confirming && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		onUI(ui, func() { confirming = ui.pages.HasPage("confirm") })
+	}
+	if !confirming {
+		t.Fatal("startup prompt sent without asking to confirm")
+	}
+	onUI(ui, func() {
+		if got := ui.systemPrompt(); got != "Be brief" {
+			t.Errorf("system prompt %q, want %q", got, "Be brief")
+		}
+	})
+}
+
+func TestMultiMegabyteLineRenderedVerbatim(t *testing.T) {
+	// A base64-like blob full of characters that open markup
+	line := strings.Repeat("QUJD*RE_`[x](", 300000)
+	for _, text := range []string{line, "- " + line, "| " + line + " |\n|---|\n"} {
+		p := NewMarkdownParser()
+		p.maxLineLength = 10000
+		full := string(p.RenderMarkdown(text))
+		if !strings.Contains(full, tview.Escape(line[20000:30000])) {
+			t.Fatalf("line past the limit not rendered verbatim")
+		}
+
+		p.Reset()
+		var b strings.Builder
+		for i := 0; i < len(text); i += 4096 {
+			b.Write(p.RenderPartial(text[i:min(i+4096, len(text))]))
+		}
+		b.Write(p.Flush())
+		if b.String() != full {
+			t.Errorf("streamed rendering of a %d byte line differs from the full rendering", len(text))
+		}
+	}
+}
+
+func TestMaxTokensFlagWinsOverProfile(t *testing.T) {
+	cfg := &Config{}
+	cfg.OpenRouter.MaxTokens = 512
+	cfg.OpenRouter.ModelProfiles = map[string]ModelProfile{"slow/reasoner": {MaxTokens: 4096}}
+	ui := &ChatUI{cfg: cfg}
+	if got := ui.modelProfile("slow/reasoner").MaxTokens; got != 4096 {
+		t.Errorf("profile max_tokens %d, want 4096", got)
+	}
+
+	cfg.MaxTokensOverride = 100
+	for _, model := range []string{"slow/reasoner", "fast/model"} {
+		if got := ui.modelProfile(model).MaxTokens; got != 100 {
+			t.Errorf("%s max_tokens %d, want the flag's 100", model, got)
+		}
+	}
+}
+
+func TestOverrideModelUsesItsTimeout(t *testing.T) {
+	cfg := &Config{}
+	cfg.OpenRouter.Model = "fast/model"
+	cfg.OpenRouter.Timeout = 30
+	cfg.OpenRouter.ModelProfiles = map[string]ModelProfile{"slow/reasoner": {Timeout: 300}}
+	ui := NewChatUI(cfg)
+
+	timeout := func(client *http.Client) time.Duration {
+		return client.Transport.(*http.Transport).ResponseHeaderTimeout
+	}
+	if got := timeout(ui.clientFor("slow/reasoner")); got != 300*time.Second {
+		t.Errorf("slow/reasoner waits %v, want 5m0s", got)
+	}
+	if got := timeout(ui.clientFor("other/model")); got != 30*time.Second {
+		t.Errorf("other/model waits %v, want 30s", got)
+	}
+	if ui.clientFor("other/model") != ui.client {
+		t.Error("models with the same timeout don't share a client")
+	}
+}
+
+func TestEnvironmentOverridesKeyWithoutDefault(t *testing.T) {
+	t.Setenv("OPENROUTER_TEMPERATURE", "0.3")
+	t.Setenv("OPENROUTER_THEME_NAME", "light")
+	cfg := testConfig(t, "openrouter:\n  api_key: sk-test\n")
+	if cfg.OpenRouter.Temperature == nil || *cfg.OpenRouter.Temperature != 0.3 {
+		t.Errorf("temperature %v, want 0.3 from OPENROUTER_TEMPERATURE", cfg.OpenRouter.Temperature)
+	}
+	if cfg.Theme.Name != "light" {
+		t.Errorf("theme %q, want light from OPENROUTER_THEME_NAME", cfg.Theme.Name)
+	}
+}
+
+func TestNestedBracketsDisplayVerbatim(t *testing.T) {
+	view := tview.NewTextView().SetDynamicColors(true)
+	for _, text := range []string{"[x[]]", "[a[b]]", "[red[]]", "see [a[]] here", "[longerword[[]]"} {
+		view.SetText(string(NewMarkdownParser().RenderMarkdown(text)))
+		if got := strings.TrimSuffix(view.GetText(true), "\n"); got != text {
+			t.Errorf("%q displays as %q", text, got)
+		}
+		marked, n := markSearchMatches(view.GetText(false), text)
+		if n != 1 {
+			t.Errorf("search for %q found %d matches in %q", text, n, marked)
+		}
+	}
+}
+
+func TestRetryKeepsModelOverride(t *testing.T) {
+	models := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req CompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		models <- req.Model
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer srv.Close()
+	ui := newTestUI(t, fmt.Sprintf("openrouter:\n  api_key: sk-test\n  base_url: %s\n  model: default/model\n", srv.URL))
+
+	onUI(ui, func() { ui.handleInput("@other/model hi") })
+	waitForResponse(t, ui)
+	onUI(ui, func() { ui.handleInput("/retry") })
+	waitForResponse(t, ui)
+
+	for i, want := range []string{"other/model", "other/model"} {
+		if got := <-models; got != want {
+			t.Errorf("request %d sent to %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestPasteWhileLoadingReported(t *testing.T) {
+	ui := newTestUI(t, "openrouter:\n  api_key: sk-test\n")
+	router := &pasteRouter{Pages: ui.pages, ui: ui}
+
+	var text string
+	var editor bool
+	onUI(ui, func() {
+		ui.mu.Lock()
+		ui.loadingActive = true
+		ui.mu.Unlock()
+		router.PasteHandler()("first\nsecond", func(tview.Primitive) {})
+		text = ui.chatHistory.GetText(true)
+		editor = ui.pages.HasPage("editor")
+	})
+	if editor {
+		t.Error("editor opened while loading")
+	}
+	if !strings.Contains(text, "wait for the current response before composing") {
+		t.Errorf("rejected paste not reported:\n%s", text)
+	}
+}
+
+func TestUndoKeyUnboundByDefault(t *testing.T) {
+	cfg := testConfig(t, "openrouter:\n  api_key: sk-test\n")
+	if cfg.Keys.Undo.Matches(tcell.NewEventKey(tcell.KeyCtrlZ, 0, tcell.ModCtrl)) {
+		t.Error("Ctrl+Z undoes by default")
+	}
+}
+
+func TestSummarizeSendsTemplatedMessages(t *testing.T) {
+	sent := make(chan []Message, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req CompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		sent <- req.Messages
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"summary"}}]}`)
+	}))
+	defer srv.Close()
+	ui := newTestUI(t, fmt.Sprintf("openrouter:\n  api_key: sk-test\n  base_url: %s\n  prompt_template: \"Q: {input}\"\n", srv.URL))
+
+	onUI(ui, func() {
+		ui.messages = []Message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "hello"}}
+		ui.handleInput("/summarize")
+	})
+	messages := <-sent
+	if messages[0].Content != "Q: hi" {
+		t.Errorf("summary sent %q, want the templated message", messages[0].Content)
+	}
+	if last := messages[len(messages)-1]; last.Content != summarizePrompt {
+		t.Errorf("summary prompt sent as %q", last.Content)
+	}
+}
+
+func TestConfirmCountsTemplatedInput(t *testing.T) {
+	template := strings.Repeat("x", 400) + " {input}"
+	ui := newTestUI(t, fmt.Sprintf("openrouter:\n  api_key: sk-test\n  prompt_template: %q\n  confirm_above_tokens: 50\n", template))
+
+	var confirm bool
+	onUI(ui, func() {
+		ui.handleInput("hi")
+		confirm = ui.pages.HasPage("confirm")
+	})
+	if !confirm {
+		t.Error("templated message over confirm_above_tokens sent without asking")
+	}
+}